@@ -64,16 +64,63 @@ func AddMap[M ~map[K]V, K comparable, V any](d *Dump, m M) {
 }
 
 // Hash hashes the values in the dump.
-// Returns the same value as the hash subcommand.
+// It's ambiguous because it concatenates the keys and values without separators, it differs from the hash subcommand's fnv2 digest.
 // Returns 0 if there are duplicated keys in the dump.
+//
+// Deprecated: Use [Dump.Digest] instead, it's versioned and unambiguous.
 func (d *Dump) Hash() uint64 {
+	if !d.sortUnique() {
+		return 0
+	}
+	return edmain.LegacyHash(d.params.Effects)
+}
+
+// Digest returns the versioned hash of the dump in the "<algo>:<hex>" form, the same as the hash subcommand with -hash=algo.
+// The algo is either "fnv2" for a FNV-64a of the length-prefixed keys and values or "sha256" for a collision-resistant SHA-256 of the same.
+// Returns an error if there are duplicated keys in the dump or if algo is unknown.
+func (d *Dump) Digest(algo string) (string, error) {
+	if !d.sortUnique() {
+		return "", fmt.Errorf("effdump/digest: duplicated keys in the dump")
+	}
+	return edmain.Digest(d.params.Effects, algo)
+}
+
+// sortUnique sorts the effects and reports whether the keys are unique.
+func (d *Dump) sortUnique() bool {
 	slices.SortFunc(d.params.Effects, func(a, b keyvalue.KV) int { return cmp.Compare(a.K, b.K) })
 	for i := 1; i < len(d.params.Effects); i++ {
 		if d.params.Effects[i].K == d.params.Effects[i-1].K {
-			return 0
+			return false
 		}
 	}
-	return edmain.Hash(d.params.Effects)
+	return true
+}
+
+// Shard returns the shard of the dump set with the -shard=i/n flag: 0 <= index < count.
+// Returns 0, 1 if the dump is not sharded.
+// Returns an error if the flag is not a valid shard spec.
+// The flags must be parsed already, e.g. with RegisterFlags and flag.Parse.
+func (d *Dump) Shard() (index, count int, err error) {
+	return edmain.ParseShard(d.params.Shard)
+}
+
+// InShard reports whether key belongs to the current shard by its hash.
+// Use it to skip generating the effects of the other shards:
+//
+//	d.RegisterFlags(flag.CommandLine)
+//	flag.Parse()
+//	for _, input := range inputs {
+//		if d.InShard(input.Name) {
+//			d.Add(input.Name, expensiveComputation(input))
+//		}
+//	}
+//
+// Then "save -shard=i/n" in each of the n CI shards and "merge" combines their dumps.
+// save drops the effects of the other shards anyway, InShard only avoids generating them.
+// It's always true if the dump is not sharded or if the -shard flag is invalid: Run reports the latter.
+func (d *Dump) InShard(key any) bool {
+	index, count, err := d.Shard()
+	return err != nil || count == 1 || edmain.ShardOf(edmain.Stringify(key), count) == index
 }
 
 // RegisterFlags registers effdump's flags into a flagset.
@@ -144,9 +191,115 @@ type VersionSystem interface {
 	Resolve(ctx context.Context, revision string) (version string, err error)
 }
 
+// Worktrees is an optional interface for a VersionSystem.
+// When implemented, diffing against a missing baseline generates it automatically:
+// effdump checks out the baseline revision into a temporary worktree, builds the same package there, and runs its save subcommand.
+type Worktrees interface {
+	// AddWorktree checks out the revision into dir.
+	// Returns the directory in the worktree that corresponds to the current working directory.
+	// effdump calls remove once it doesn't need the worktree anymore.
+	AddWorktree(ctx context.Context, revision, dir string) (workdir string, remove func() error, err error)
+}
+
+// Describer is an optional interface for a VersionSystem.
+// When implemented, the versions subcommand shows the description of each saved version.
+type Describer interface {
+	// Describe returns a short, one line description of the version such as its commit's subject.
+	Describe(ctx context.Context, version string) (description string, err error)
+}
+
 // SetVersionSystem overrides the version control system effdump uses.
 // The default is git if this function isn't called.
+// vs can optionally implement [Worktrees] and [Describer] too.
 func (d *Dump) SetVersionSystem(vs VersionSystem) {
 	d.params.VSHasChanges = vs.HasChanges
 	d.params.VSResolve = vs.Resolve
+	d.params.VSWorktree = nil
+	if wt, ok := vs.(Worktrees); ok {
+		d.params.VSWorktree = wt.AddWorktree
+	}
+	d.params.VSDescribe = nil
+	if desc, ok := vs.(Describer); ok {
+		d.params.VSDescribe = desc.Describe
+	}
+}
+
+// Store stores the saved dumps.
+// Each dump is an opaque, compressed blob identified by its version.
+// The versions are short alphanumeric identifiers.
+type Store interface {
+	// Get returns version's dump.
+	// Returns an error wrapping fs.ErrNotExist if the version wasn't saved yet.
+	Get(ctx context.Context, version string) (data []byte, err error)
+
+	// Put saves version's dump, replacing the previous one if it exists.
+	Put(ctx context.Context, version string, data []byte) error
+
+	// List returns all the saved versions.
+	List(ctx context.Context) (versions []string, err error)
+
+	// Delete deletes version's dump.
+	Delete(ctx context.Context, version string) error
+}
+
+// NewDirStore returns a Store that saves each dump into dir as a <version>.gz file.
+// This is the default Store:
+// effdump uses a per-user, per-dump directory in os.TempDir() or the directory in the EFFDUMP_DIR envvar.
+func NewDirStore(dir string) Store {
+	return edmain.NewDirStore(dir)
+}
+
+// SetGolden switches the dump into golden-file mode: the baseline is the textar file at path instead of the saved dumps.
+// This is for the dumps whose expectations need to be committed into the repository.
+// The update subcommand rewrites the file and the check subcommand fails if the current version differs from it.
+// The path is relative to the working directory.
+// The -golden flag overrides it.
+// Call it before parsing the flags.
+func (d *Dump) SetGolden(path string) {
+	d.params.Golden = path
+}
+
+// SetLimits overrides the maximum number of entries and the maximum total size in bytes of the dump.
+// The defaults are 10K entries and 10 MB.
+// The limits protect against running out of memory on huge or corrupted dumps.
+// The diffs stream the saved baseline shard by shard but the current effects and the diffs are in memory, so raise them only as far as the available memory allows.
+// Zero or negative values keep the respective default.
+func (d *Dump) SetLimits(maxEntries, maxBytes int) {
+	d.params.Limits = edmain.Limits{maxEntries, maxBytes}
+}
+
+// SetDelta makes the save subcommand store only the changes against the parent revision's saved dump.
+// The parent revision is resolved through the [VersionSystem], e.g. HEAD^ in git.
+// Saving a full dump after maxChain deltas in a row keeps the chains short; loading a delta needs all its parents up to the nearest full dump.
+// This is for saving every commit, e.g. from a post-commit hook, where consecutive versions differ in a handful of effects.
+// 0 disables the deltas, that's the default.
+// The -delta flag overrides it.
+// Call it before parsing the flags.
+func (d *Dump) SetDelta(maxChain int) {
+	d.params.Delta = maxChain
+}
+
+// SetDiffAlgorithm sets the diff algorithm for the keys matching any of the keyglobs, or for all keys if there are none.
+// The algo is one of anchored, myers, patience, or histogram; anchored is the default.
+// Use it for the effects where the default produces hard to read diffs.
+// Later calls take precedence for the keys matching multiple calls' globs.
+// The -algo flag overrides all of them.
+func (d *Dump) SetDiffAlgorithm(algo string, keyglobs ...string) {
+	d.params.DiffAlgos = append(d.params.DiffAlgos, edmain.DiffAlgo{edmain.MakeRE(keyglobs...), algo})
+}
+
+// NewCASStore returns a content-addressed Store in dir.
+// It stores each distinct value only once, so saving a version similar to an already saved one is cheap.
+// Each version is a small index of the keys and their value's hash.
+// The gc and clear subcommands delete the values no saved version references anymore.
+// It rejects the dumps over the dump's limits, see [Dump.SetLimits].
+// Set EFFDUMP_STORE=cas to use it in the EFFDUMP_DIR directory without code changes.
+func NewCASStore(dir string) Store {
+	return edmain.NewCASStore(dir, edmain.Limits{})
+}
+
+// SetStore overrides where effdump saves the dumps.
+// The default is a [NewDirStore] store if this function isn't called.
+func (d *Dump) SetStore(s Store) {
+	d.params.Store = s
 }
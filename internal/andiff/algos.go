@@ -0,0 +1,301 @@
+package andiff
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The names of the supported diff algorithms.
+const (
+	Anchored  = "anchored"  // the default, see Compute
+	Myers     = "myers"     // the minimal diff, like GNU diff
+	Patience  = "patience"  // anchors on the lines unique on both sides, then the rest with myers
+	Histogram = "histogram" // anchors on the least frequent lines, git's default for --histogram
+)
+
+// Algorithms is the list of the supported diff algorithms.
+var Algorithms = []string{Anchored, Myers, Patience, Histogram}
+
+// CheckAlgorithm returns an error if algo is not one of Algorithms.
+func CheckAlgorithm(algo string) error {
+	if !slices.Contains(Algorithms, algo) {
+		return fmt.Errorf("andiff/check algorithm: got %q, want one of %s", algo, strings.Join(Algorithms, ", "))
+	}
+	return nil
+}
+
+// maxHistogramChain is the maximum number of occurrences of a line for the histogram algorithm to consider it as an anchor.
+const maxHistogramChain = 64
+
+// ComputeAlgo is like Compute but with the given algorithm, one of Algorithms.
+// The empty algo means Anchored.
+// The Hash of the resulting Diff depends only on the deleted and added lines of each Op and on the moved blocks.
+// So the same change hashes the same regardless of the algorithm as long as the algorithm splits it up into the same Ops.
+func ComputeAlgo(algo, lt, rt string, rmregexp *regexp.Regexp) Diff {
+	if algo == "" || algo == Anchored {
+		return Compute(lt, rt, rmregexp)
+	}
+	origx, origy, x, y := prepare(lt, rt, rmregexp)
+	if strings.Join(x, "\n") == strings.Join(y, "\n") {
+		return Diff{origx, origy, []Op{{0, 0, len(x)}}, nil, 0}
+	}
+
+	// Map the lines to ints to make the comparisons cheap.
+	ids := map[string]int{}
+	intern := func(ss []string) []int {
+		r := make([]int, len(ss))
+		for i, s := range ss {
+			id, ok := ids[s]
+			if !ok {
+				id = len(ids)
+				ids[s] = id
+			}
+			r[i] = id
+		}
+		return r
+	}
+	m := &matcher{x: intern(x), y: intern(y), algo: algo}
+	m.match(0, len(x), 0, len(y))
+	d := build(origx, origy, x, y, m.ms)
+	d.addMoves(x, y)
+	return d
+}
+
+// prepare splits the inputs into lines and removes the rmregexp matches from them.
+// Returns the original lines and the lines to diff.
+func prepare(lt, rt string, rmregexp *regexp.Regexp) (origx, origy, x, y []string) {
+	origx, origy = split(lt), split(rt)
+	x, y = origx, origy
+	if rmregexp != nil {
+		x, y = slices.Clone(x), slices.Clone(y)
+		for i, s := range x {
+			x[i] = rmregexp.ReplaceAllString(s, "")
+		}
+		for i, s := range y {
+			y[i] = rmregexp.ReplaceAllString(s, "")
+		}
+	}
+	return origx, origy, x, y
+}
+
+// build turns the increasing list of the matching line pairs into a Diff.
+// It hashes the changed lines the same way Compute does.
+func build(origx, origy, x, y []string, ms []pair) Diff {
+	h := fnv.New64()
+	ops, xi, yi := make([]Op, 0, 3), 0, 0
+	for len(ms) > 0 || xi < len(x) || yi < len(y) {
+		nxi, nyi, keep := len(x), len(y), 0
+		if len(ms) > 0 {
+			nxi, nyi = ms[0].x, ms[0].y
+			for keep < len(ms) && ms[keep] == (pair{nxi + keep, nyi + keep}) {
+				keep++
+			}
+			ms = ms[keep:]
+		}
+		for i := xi; i < nxi; i++ {
+			h.Write([]byte("\n-"))
+			h.Write([]byte(x[i]))
+		}
+		for i := yi; i < nyi; i++ {
+			h.Write([]byte("\n+"))
+			h.Write([]byte(y[i]))
+		}
+		ops = append(ops, Op{nxi - xi, nyi - yi, keep})
+		xi, yi = nxi+keep, nyi+keep
+	}
+	return Diff{origx, origy, ops, nil, h.Sum64()}
+}
+
+// matcher collects the matching line pairs of x and y into ms in increasing order.
+type matcher struct {
+	x, y []int
+	algo string
+	ms   []pair
+}
+
+// match matches x[x0:x1] against y[y0:y1] with the matcher's algorithm.
+func (m *matcher) match(x0, x1, y0, y1 int) {
+	// Match the common prefix and suffix first: all algorithms would do that anyway.
+	for x0 < x1 && y0 < y1 && m.x[x0] == m.y[y0] {
+		m.ms, x0, y0 = append(m.ms, pair{x0, y0}), x0+1, y0+1
+	}
+	suffix := 0
+	for x0 < x1-suffix && y0 < y1-suffix && m.x[x1-suffix-1] == m.y[y1-suffix-1] {
+		suffix++
+	}
+	x1, y1 = x1-suffix, y1-suffix
+	if x0 < x1 && y0 < y1 {
+		switch m.algo {
+		case Patience:
+			m.patience(x0, x1, y0, y1)
+		case Histogram:
+			m.histogram(x0, x1, y0, y1)
+		default:
+			m.myers(x0, x1, y0, y1)
+		}
+	}
+	for i := 0; i < suffix; i++ {
+		m.ms = append(m.ms, pair{x1 + i, y1 + i})
+	}
+}
+
+// myers matches the longest common subsequence using the linear space variant of Myers' algorithm.
+// It splits the ranges at the middle snake and recurses into the two halves.
+// See Eugene W. Myers, "An O(ND) Difference Algorithm and Its Variations", Algorithmica 1 (1986).
+// The ranges must be non-empty and must start and end with differing lines.
+func (m *matcher) myers(x0, x1, y0, y1 int) {
+	nx, ny := x1-x0, y1-y0
+	delta, limit := nx-ny, (nx+ny+1)/2
+	off := limit + 1
+	vf, vb := make([]int, 2*limit+3), make([]int, 2*limit+3)
+	for d := 0; d <= limit; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := vf[off+k-1] + 1
+			if k == -d || k != d && vf[off+k-1] < vf[off+k+1] {
+				x = vf[off+k+1]
+			}
+			sx := x
+			for x < nx && x-k < ny && m.x[x0+x] == m.y[y0+x-k] {
+				x++
+			}
+			vf[off+k] = x
+			if kr := delta - k; delta%2 != 0 && -(d-1) <= kr && kr <= d-1 && x+vb[off+kr] >= nx {
+				m.split(x0, x1, y0, y1, x0+sx, y0+sx-k, x-sx)
+				return
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			x := vb[off+k-1] + 1
+			if k == -d || k != d && vb[off+k-1] < vb[off+k+1] {
+				x = vb[off+k+1]
+			}
+			sx := x
+			for x < nx && x-k < ny && m.x[x1-1-x] == m.y[y1-1-(x-k)] {
+				x++
+			}
+			vb[off+k] = x
+			if kf := delta - k; delta%2 == 0 && -d <= kf && kf <= d && x+vf[off+kf] >= nx {
+				m.split(x0, x1, y0, y1, x1-x, y1-(x-k), x-sx)
+				return
+			}
+		}
+	}
+	panic("andiff/myers: no middle snake found")
+}
+
+// split matches the snake of length l at x[sx] and y[sy] and recurses into the ranges around it.
+func (m *matcher) split(x0, x1, y0, y1, sx, sy, l int) {
+	m.match(x0, sx, y0, sy)
+	for i := 0; i < l; i++ {
+		m.ms = append(m.ms, pair{sx + i, sy + i})
+	}
+	m.match(sx+l, x1, sy+l, y1)
+}
+
+// patience anchors on the longest common subsequence of the lines unique in both ranges and recurses into the ranges between them.
+// Falls back to myers if there are no such lines.
+func (m *matcher) patience(x0, x1, y0, y1 int) {
+	// Count the lines: 1 and 2 for the unique and non-unique lines of x, 4 and 8 for y.
+	cnt := map[int]int{}
+	for _, id := range m.x[x0:x1] {
+		if c := cnt[id]; c&3 < 2 {
+			cnt[id] = c + 1
+		}
+	}
+	for _, id := range m.y[y0:y1] {
+		if c := cnt[id]; c&12 < 8 {
+			cnt[id] = c + 4
+		}
+	}
+	ypos := map[int]int{}
+	for i := y0; i < y1; i++ {
+		if cnt[m.y[i]] == 1+4 {
+			ypos[m.y[i]] = i
+		}
+	}
+	var uniq []pair
+	for i := x0; i < x1; i++ {
+		if j, ok := ypos[m.x[i]]; ok {
+			uniq = append(uniq, pair{i, j})
+		}
+	}
+	anchors := lis(uniq)
+	if len(anchors) == 0 {
+		m.myers(x0, x1, y0, y1)
+		return
+	}
+	for _, a := range anchors {
+		m.match(x0, a.x, y0, a.y)
+		m.ms, x0, y0 = append(m.ms, a), a.x+1, a.y+1
+	}
+	m.match(x0, x1, y0, y1)
+}
+
+// lis returns the longest subsequence of ps (increasing in x) that is increasing in y too.
+func lis(ps []pair) []pair {
+	// tails[i] is the index of the smallest y ending an increasing subsequence of length i+1.
+	var tails []int
+	prev := make([]int, len(ps))
+	for i, p := range ps {
+		k, _ := slices.BinarySearchFunc(tails, p.y, func(t, y int) int { return ps[t].y - y })
+		prev[i] = -1
+		if k > 0 {
+			prev[i] = tails[k-1]
+		}
+		if k == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[k] = i
+		}
+	}
+	if len(tails) == 0 {
+		return nil
+	}
+	r := make([]pair, len(tails))
+	for i, k := len(tails)-1, tails[len(tails)-1]; i >= 0; i, k = i-1, prev[k] {
+		r[i] = ps[k]
+	}
+	return r
+}
+
+// histogram anchors on the common region with the least frequent lines of x and recurses into the ranges around it.
+// It picks the lowest occurrence count first and breaks the ties by the region's length.
+// This is the algorithm of git's diff --histogram.
+// Falls back to myers if all common lines are too frequent.
+func (m *matcher) histogram(x0, x1, y0, y1 int) {
+	xpos := map[int][]int{}
+	for i := x0; i < x1; i++ {
+		xpos[m.x[i]] = append(xpos[m.x[i]], i)
+	}
+	bestx, besty, bestlen, bestcnt := 0, 0, 0, maxHistogramChain+1
+	for j := y0; j < y1; {
+		next := j + 1
+		if len(xpos[m.y[j]]) > bestcnt {
+			j = next
+			continue
+		}
+		for _, i := range xpos[m.y[j]] {
+			// Extend the match around x[i] and y[j] and track its least frequent line.
+			xs, ys, xe, ye, cnt := i, j, i+1, j+1, len(xpos[m.y[j]])
+			for xs > x0 && ys > y0 && m.x[xs-1] == m.y[ys-1] {
+				xs, ys, cnt = xs-1, ys-1, min(cnt, len(xpos[m.x[xs-1]]))
+			}
+			for xe < x1 && ye < y1 && m.x[xe] == m.y[ye] {
+				xe, ye, cnt = xe+1, ye+1, min(cnt, len(xpos[m.x[xe]]))
+			}
+			if cnt < bestcnt || cnt == bestcnt && xe-xs > bestlen {
+				bestx, besty, bestlen, bestcnt = xs, ys, xe-xs, cnt
+			}
+			next = max(next, ye)
+		}
+		j = next
+	}
+	if bestlen == 0 {
+		m.myers(x0, x1, y0, y1)
+		return
+	}
+	m.split(x0, x1, y0, y1, bestx, besty, bestlen)
+}
@@ -6,7 +6,6 @@ package andiff
 import (
 	"hash/fnv"
 	"regexp"
-	"slices"
 	"sort"
 	"strings"
 )
@@ -23,6 +22,9 @@ type Diff struct {
 
 	Ops []Op
 
+	// The blocks deleted in one Op and added verbatim in another, the Hash includes them.
+	Moves []Move
+
 	Hash uint64
 }
 
@@ -42,19 +44,9 @@ func split(s string) []string {
 // Compute computes the Diff between two strings.
 // If rmregexp is non-nil, the matching parts are removed from each line first.
 func Compute(lt, rt string, rmregexp *regexp.Regexp) Diff {
-	origx, origy := split(lt), split(rt)
-	x, y := origx, origy
-	if rmregexp != nil {
-		x, y = slices.Clone(x), slices.Clone(y)
-		for i, s := range x {
-			x[i] = rmregexp.ReplaceAllString(s, "")
-		}
-		for i, s := range y {
-			y[i] = rmregexp.ReplaceAllString(s, "")
-		}
-	}
+	origx, origy, x, y := prepare(lt, rt, rmregexp)
 	if strings.Join(x, "\n") == strings.Join(y, "\n") {
-		return Diff{origx, origy, []Op{{0, 0, len(x)}}, 0}
+		return Diff{origx, origy, []Op{{0, 0, len(x)}}, nil, 0}
 	}
 	h := fnv.New64()
 
@@ -163,7 +155,9 @@ func Compute(lt, rt string, rmregexp *regexp.Regexp) Diff {
 		}
 		ops = append(ops, Op{len(x) - xi, len(y) - yi, 0})
 	}
-	return Diff{origx, origy, ops, h.Sum64()}
+	d := Diff{origx, origy, ops, nil, h.Sum64()}
+	d.addMoves(x, y)
+	return d
 }
 
 func countIndent(s string) int {
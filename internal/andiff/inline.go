@@ -0,0 +1,120 @@
+package andiff
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Span is a [Start, End) byte range of a line.
+type Span struct {
+	Start, End int
+}
+
+// maxInlineCells bounds the size of the dynamic programming table of Inline.
+// The longer lines fall back to comparing only their common prefix and suffix.
+const maxInlineCells = 1 << 20
+
+// tokenize splits a line into words, whitespace runs, and single punctuation characters.
+// Returns the start offset of each token followed by the line's length.
+func tokenize(s string) []int {
+	var offsets []int
+	class := func(r rune) int {
+		switch {
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			return 1
+		case unicode.IsSpace(r):
+			return 2
+		}
+		return 0
+	}
+	prev := -1
+	for i, r := range s {
+		c := class(r)
+		if c == 0 || c != prev {
+			offsets = append(offsets, i)
+		}
+		prev = c
+	}
+	return append(offsets, len(s))
+}
+
+// Inline computes the changed spans between a deleted and an added line on word granularity.
+// It's for highlighting the changes within the paired lines of a diff.
+// Returns nil spans if the lines have too little in common for the highlighting to be useful.
+func Inline(lt, rt string) (ltspans, rtspans []Span) {
+	if !utf8.ValidString(lt) || !utf8.ValidString(rt) {
+		return nil, nil
+	}
+	xo, yo := tokenize(lt), tokenize(rt)
+	x, y := make([]string, len(xo)-1), make([]string, len(yo)-1)
+	for i := range x {
+		x[i] = lt[xo[i]:xo[i+1]]
+	}
+	for i := range y {
+		y[i] = rt[yo[i]:yo[i+1]]
+	}
+
+	// Mark the tokens of the longest common subsequence.
+	xkeep, ykeep := make([]bool, len(x)), make([]bool, len(y))
+	pre, suf := 0, 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		xkeep[pre], ykeep[pre], pre = true, true, pre+1
+	}
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		xkeep[len(x)-1-suf], ykeep[len(y)-1-suf], suf = true, true, suf+1
+	}
+	mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	if n, m := len(mx), len(my); n > 0 && m > 0 && (n+1)*(m+1) <= maxInlineCells {
+		// lcs[i][j] is the length of the longest common subsequence of mx[i:] and my[j:].
+		lcs := make([]int32, (n+1)*(m+1))
+		at := func(i, j int) *int32 { return &lcs[i*(m+1)+j] }
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if mx[i] == my[j] {
+					*at(i, j) = *at(i+1, j+1) + 1
+				} else {
+					*at(i, j) = max(*at(i+1, j), *at(i, j+1))
+				}
+			}
+		}
+		for i, j := 0, 0; i < n && j < m; {
+			switch {
+			case mx[i] == my[j]:
+				xkeep[pre+i], ykeep[pre+j], i, j = true, true, i+1, j+1
+			case *at(i+1, j) >= *at(i, j+1):
+				i++
+			default:
+				j++
+			}
+		}
+	}
+
+	// Skip the highlighting if most of the lines changed: it would be just noise.
+	common := 0
+	for i, keep := range xkeep {
+		if keep && strings.TrimSpace(x[i]) != "" {
+			common += len(x[i])
+		}
+	}
+	if 2*common < max(len(lt), len(rt)) {
+		return nil, nil
+	}
+	return spans(xo, xkeep), spans(yo, ykeep)
+}
+
+// spans returns the merged byte ranges of the tokens not kept.
+func spans(offsets []int, keep []bool) []Span {
+	var ss []Span
+	for i, k := range keep {
+		if k {
+			continue
+		}
+		if len(ss) > 0 && ss[len(ss)-1].End == offsets[i] {
+			ss[len(ss)-1].End = offsets[i+1]
+		} else {
+			ss = append(ss, Span{offsets[i], offsets[i+1]})
+		}
+	}
+	return ss
+}
@@ -0,0 +1,132 @@
+package andiff
+
+import (
+	"hash/fnv"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Move describes a block deleted from LT[Del:Del+Len] and added verbatim as RT[Add:Add+Len] in a different Op.
+type Move struct {
+	Del, Add, Len int
+}
+
+// minMoveLines is the minimum number of lines with a letter or a digit in a moved block.
+// The shorter blocks are more likely coincidences such as closing braces than actual moves.
+const minMoveLines = 3
+
+// maxMoveCandidates limits the number of deleted lines findMoves tries to start a block from for each added line.
+const maxMoveCandidates = 64
+
+// findMoves finds the blocks deleted in one Op and added verbatim in another.
+// x and y are the lines the ops were computed on.
+// Returns the moves in the order of their added blocks, preferring the longest block at each added line.
+func findMoves(x, y []string, ops []Op) []Move {
+	delop, addop := make([]int, len(x)), make([]int, len(y))
+	delpos := map[string][]int{}
+	xi, yi := 0, 0
+	for i, op := range ops {
+		for k := 0; k < op.Keep; k++ {
+			delop[xi+op.Del+k], addop[yi+op.Add+k] = -1, -1
+		}
+		for k := 0; k < op.Del; k++ {
+			delop[xi+k], delpos[x[xi+k]] = i, append(delpos[x[xi+k]], xi+k)
+		}
+		for k := 0; k < op.Add; k++ {
+			addop[yi+k] = i
+		}
+		xi, yi = xi+op.Del+op.Keep, yi+op.Add+op.Keep
+	}
+
+	var moves []Move
+	moved := make([]bool, len(x))
+	for ya := 0; ya < len(y); ya++ {
+		if addop[ya] < 0 {
+			continue
+		}
+		best := Move{}
+		for _, xa := range delpos[y[ya]][:min(len(delpos[y[ya]]), maxMoveCandidates)] {
+			if moved[xa] || delop[xa] == addop[ya] {
+				continue
+			}
+			n, significant := 0, 0
+			for ya+n < len(y) && xa+n < len(x) && addop[ya+n] == addop[ya] && delop[xa+n] == delop[xa] && !moved[xa+n] && x[xa+n] == y[ya+n] {
+				if strings.IndexFunc(y[ya+n], isAlnum) >= 0 {
+					significant++
+				}
+				n++
+			}
+			if significant >= minMoveLines && n > best.Len {
+				best = Move{xa, ya, n}
+			}
+		}
+		if best.Len == 0 {
+			continue
+		}
+		moves = append(moves, best)
+		for k := 0; k < best.Len; k++ {
+			moved[best.Del+k] = true
+		}
+		ya += best.Len - 1
+	}
+	return moves
+}
+
+func isAlnum(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+
+// hashMoves hashes the changed lines like Compute but the moved blocks separately.
+// The moved blocks are hashed sorted by their content so a block hashes the same regardless of where it moved.
+func hashMoves(x, y []string, ops []Op, moves []Move) uint64 {
+	d := Diff{LT: x, RT: y, Ops: ops, Moves: moves}
+	ltmoved, rtmoved := d.Moved()
+	h := fnv.New64()
+	xi, yi := 0, 0
+	for _, op := range ops {
+		for i := xi; i < xi+op.Del; i++ {
+			if !ltmoved[i] {
+				h.Write([]byte("\n-"))
+				h.Write([]byte(x[i]))
+			}
+		}
+		for i := yi; i < yi+op.Add; i++ {
+			if !rtmoved[i] {
+				h.Write([]byte("\n+"))
+				h.Write([]byte(y[i]))
+			}
+		}
+		xi, yi = xi+op.Del+op.Keep, yi+op.Add+op.Keep
+	}
+	blocks := make([]string, len(moves))
+	for i, m := range moves {
+		blocks[i] = strings.Join(y[m.Add:m.Add+m.Len], "\n")
+	}
+	slices.Sort(blocks)
+	for _, b := range blocks {
+		h.Write([]byte("\n="))
+		for _, line := range strings.Split(b, "\n") {
+			h.Write([]byte("\n>"))
+			h.Write([]byte(line))
+		}
+	}
+	return h.Sum64()
+}
+
+// addMoves detects the moved blocks of d and rehashes it if it has any.
+// x and y are the lines the diff was computed on.
+func (d *Diff) addMoves(x, y []string) {
+	if d.Moves = findMoves(x, y, d.Ops); len(d.Moves) > 0 {
+		d.Hash = hashMoves(x, y, d.Ops, d.Moves)
+	}
+}
+
+// Moved reports for each line of LT and RT whether it's part of a moved block.
+func (d Diff) Moved() (ltmoved, rtmoved []bool) {
+	ltmoved, rtmoved = make([]bool, len(d.LT)), make([]bool, len(d.RT))
+	for _, m := range d.Moves {
+		for k := 0; k < m.Len; k++ {
+			ltmoved[m.Del+k], rtmoved[m.Add+k] = true, true
+		}
+	}
+	return ltmoved, rtmoved
+}
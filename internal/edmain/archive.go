@@ -0,0 +1,138 @@
+package edmain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/edtextar"
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// cmdExport writes a saved version into a portable textar archive.
+// The archive is gzip compressed if the file name ends with .gz.
+// A "-" file writes the plain textar to stdout.
+func (p *Params) cmdExport(ctx context.Context, version, file string) error {
+	data, err := p.Store.Get(ctx, version)
+	if err != nil {
+		return fmt.Errorf("edmain/load %s: %v", version, err)
+	}
+	kvs, _, err := p.decode(ctx, version, data)
+	if err != nil {
+		return fmt.Errorf("edmain/unmarshal %s: %v", version, err)
+	}
+	ar := edtextar.Format(kvs, p.Sepch[0])
+	if file == "-" {
+		_, err := io.WriteString(p.Stdout, ar)
+		return err
+	}
+	out := []byte(ar)
+	if strings.HasSuffix(file, ".gz") {
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		io.WriteString(w, ar)
+		w.Close()
+		out = buf.Bytes()
+	}
+	if err := writeFileAtomic(file, out); err != nil {
+		return fmt.Errorf("edmain/write archive: %v", err)
+	}
+	fmt.Fprintf(p.Stdout, "Exported %s (%d entries) to %s.\n", version, len(kvs), file)
+	return nil
+}
+
+// readArchive reads and validates a textar archive, gzip compressed or plain.
+// It rejects the archives with unsorted or duplicate keys or over the limits.
+func readArchive(file string, lim Limits) ([]keyvalue.KV, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/open archive: %v", err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	magic := make([]byte, 2)
+	if n, _ := io.ReadFull(f, magic); n == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		f.Seek(0, io.SeekStart)
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("edmain/init decompressor: %v", err)
+		}
+		r = gz
+	} else {
+		f.Seek(0, io.SeekStart)
+	}
+	limr := &io.LimitedReader{r, int64(lim.MaxBytes + 1)}
+	ar, err := io.ReadAll(limr)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/read archive: %v", err)
+	}
+	if limr.N == 0 {
+		return nil, fmt.Errorf("edmain/check limits: archive is over the limit of %d bytes", lim.MaxBytes)
+	}
+	kvs := edtextar.Parse(nil, string(ar))
+	if len(kvs) > lim.MaxEntries {
+		return nil, fmt.Errorf("edmain/check limits: archive has %d entries, limit is %d", len(kvs), lim.MaxEntries)
+	}
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].K == kvs[i-1].K {
+			return nil, fmt.Errorf("edmain/unique check: key %q duplicated", kvs[i].K)
+		}
+		if kvs[i].K < kvs[i-1].K {
+			return nil, fmt.Errorf("edmain/sort check: %dth key (%q) not in order", i, kvs[i].K)
+		}
+	}
+	return kvs, nil
+}
+
+// cmdImport validates a textar archive and saves it as a version.
+func (p *Params) cmdImport(ctx context.Context, file string) error {
+	version, err := p.importVersion(file)
+	if err != nil {
+		return err
+	}
+	kvs, err := readArchive(file, p.Limits)
+	if err != nil {
+		return err
+	}
+	return p.saveImported(ctx, version, file, kvs)
+}
+
+// importVersion returns the version name for an imported file or directory.
+// It defaults to the file's name without its extensions.
+func (p *Params) importVersion(file string) (string, error) {
+	version := p.Version
+	if version == "" {
+		version, _, _ = strings.Cut(filepath.Base(file), ".")
+	}
+	if !isIdentifier(version) {
+		return "", fmt.Errorf("edmain/check version: %q is not a short alphanumeric identifier, specify the version with -version", version)
+	}
+	return version, nil
+}
+
+// saveImported saves the sorted and validated kvs imported from source as version.
+// It doesn't overwrite existing versions unless -force is set.
+func (p *Params) saveImported(ctx context.Context, version, source string, kvs []keyvalue.KV) error {
+	if _, err := p.Store.Get(ctx, version); err == nil && !p.Force {
+		return fmt.Errorf("edmain/check existing: version %s already exists, use -force to overwrite it", version)
+	}
+	digest, err := Digest(kvs, p.HashAlgo)
+	if err != nil {
+		return err
+	}
+	m := &Manifest{Format: formatVersion, SaveTime: p.Now().UTC(), Hash: digest, Imported: filepath.Base(source), Flags: []string{"-sepch=" + p.Sepch}, Sepch: p.Sepch}
+	buf, err := Compress(kvs, p.Sepch[0], Hash(kvs), m, p.Limits)
+	if err != nil {
+		return fmt.Errorf("edmain/marshal: %v", err)
+	}
+	if err := p.put(ctx, version, buf); err != nil {
+		return fmt.Errorf("edmain/save: %v", err)
+	}
+	fmt.Fprintf(p.Stdout, "Imported %s (%d entries) as %s.\n", source, len(kvs), p.where(version))
+	return nil
+}
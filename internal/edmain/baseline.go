@@ -0,0 +1,218 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// buildtarget returns the package path and the build tags of the running binary.
+func buildtarget() (pkg, tags string, err error) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", "", fmt.Errorf("edmain/read buildinfo: couldn't fetch buildinfo")
+	}
+	if bi.Path == "command-line-arguments" {
+		return "", "", fmt.Errorf("edmain/check target: go run target must be of form yourmodule/yourpackage, specifying .go files directly is not supported")
+	}
+	for _, setting := range bi.Settings {
+		if setting.Key == "-tags" {
+			tags = setting.Value
+		}
+	}
+	return bi.Path, tags, nil
+}
+
+// gobuild compiles edpkg into edbin from the dir directory.
+// Returns the compiler's output on error.
+func gobuild(ctx context.Context, gobin, dir, edpkg, edbin, tags string) (output []byte, err error) {
+	cmd := exec.CommandContext(ctx, gobin, "build", "-tags="+tags, "-o="+edbin, edpkg)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+// buildVersion generates a missing dump.
+// It checks out rev into a temporary worktree, builds the same package there, and runs its save subcommand to save it as version.
+// The save goes into a temporary directory, then the dump is copied into the local store: it's never uploaded to the remote.
+func (p *Params) buildVersion(ctx context.Context, rev, version string) error {
+	edpkg, tags, err := buildtarget()
+	if err != nil {
+		return err
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		return fmt.Errorf("edmain/find go binary: %v", err)
+	}
+	if err := os.MkdirAll(p.tmpdir, 0o755); err != nil {
+		return fmt.Errorf("edmain/make dump dir: %v", err)
+	}
+	dir, err := os.MkdirTemp(p.tmpdir, "worktree-")
+	if err != nil {
+		return fmt.Errorf("edmain/make worktree dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Fprintf(os.Stderr, "NOTE: effdump for %s not found, generating it in a temporary worktree... ", version)
+	workdir, remove, err := p.VSWorktree(ctx, rev, dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("edmain/add worktree: %v", err)
+	}
+	defer remove()
+
+	edbin := filepath.Join(dir, "effdump-baseline")
+	if output, err := gobuild(ctx, gobin, workdir, edpkg, edbin, tags); err != nil {
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("edmain/build baseline: %v\n%s", err, output)
+	}
+	// Save into a private directory without the remote: the worktree-built dump is only for this machine.
+	// The baseline's code might predate the store settings so copy the dump into the store afterwards.
+	outdir := filepath.Join(dir, "dumps")
+	env := slices.DeleteFunc(slices.Clone(p.Env), func(e string) bool {
+		return strings.HasPrefix(e, "EFFDUMP_DIR=") || strings.HasPrefix(e, "EFFDUMP_STORE=") || strings.HasPrefix(e, "EFFDUMP_REMOTE=")
+	})
+	cmd := exec.CommandContext(ctx, edbin, "-version="+version, "-sepch="+p.Sepch, "save")
+	cmd.Dir, cmd.Env = workdir, append(env, "EFFDUMP_DIR="+outdir, "EFFDUMP_STORE=dir")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("edmain/run baseline save: %v\n%s", err, output)
+	}
+	data, err := NewDirStore(outdir).Get(ctx, version)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, err := p.Store.Get(ctx, version); err == nil {
+			fmt.Fprintln(os.Stderr, "done.")
+			return nil // the baseline's code saved into the same custom store
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("edmain/read baseline save: %v", err)
+	}
+	if err := localStore(p.Store).Put(ctx, version, data); err != nil {
+		fmt.Fprintln(os.Stderr)
+		return fmt.Errorf("edmain/store baseline: %v", err)
+	}
+	fmt.Fprintln(os.Stderr, "done.")
+	return nil
+}
+
+// resolveSaved resolves ref which is either a saved version or a revision.
+// Returns the revision the version can be generated from, or empty string if ref was a saved version.
+func (p *Params) resolveSaved(ctx context.Context, ref string) (version, rev string, err error) {
+	if isIdentifier(ref) {
+		if _, err := p.Store.Get(ctx, ref); err == nil {
+			return ref, "", nil
+		}
+	}
+	version, err = p.VSResolve(ctx, ref)
+	if err != nil {
+		return "", "", fmt.Errorf("edmain/resolve %q: not a saved version and not a revision: %v", ref, err)
+	}
+	if !isIdentifier(version) {
+		return "", "", fmt.Errorf("edmain/check version: %q is not a short alphanumeric identifier", version)
+	}
+	return version, ref, nil
+}
+
+// entryStream iterates over a saved version's entries and checks their order.
+// It streams the full dumps through a DumpReader, the delta dumps are rebuilt into kvs upfront.
+type entryStream struct {
+	version string
+	d       *DumpReader   // nil if kvs holds the entries
+	kvs     []keyvalue.KV // the entries not returned yet
+	last    string        // the last returned key
+	n       int           // the number of entries returned so far
+	err     error
+}
+
+// Next returns the next entry.
+// Returns false at the end of the entries or on error, see Err.
+func (s *entryStream) Next() (keyvalue.KV, bool) {
+	var kv keyvalue.KV
+	switch {
+	case s.err != nil:
+		return keyvalue.KV{}, false
+	case s.d != nil:
+		var ok bool
+		if kv, ok = s.d.Next(); !ok {
+			if err := s.d.Err(); err != nil {
+				s.err = fmt.Errorf("edmain/unmarshal dump: %v", err)
+			}
+			return keyvalue.KV{}, false
+		}
+	case len(s.kvs) == 0:
+		return keyvalue.KV{}, false
+	default:
+		kv, s.kvs = s.kvs[0], s.kvs[1:]
+	}
+	if s.n > 0 && kv.K <= s.last {
+		s.err = fmt.Errorf("edmain/sort check of %s: %dth key not in order (corrupted? re-save the version)", s.version, s.n)
+		return keyvalue.KV{}, false
+	}
+	s.last, s.n = kv.K, s.n+1
+	return kv, true
+}
+
+// Err returns the first error Next encountered.
+func (s *entryStream) Err() error { return s.err }
+
+// open opens a saved version for reading its entries one by one.
+// If the version is missing and buildable is set then it generates the version from rev first.
+func (p *Params) open(ctx context.Context, version, rev string, buildable bool) (*entryStream, *Manifest, error) {
+	buf, err := p.Store.Get(ctx, version)
+	if err != nil && errors.Is(err, fs.ErrNotExist) && p.Autosave && buildable && p.VSWorktree != nil {
+		if err := p.buildVersion(ctx, rev, version); err != nil {
+			return nil, nil, fmt.Errorf("edmain/build version %s: %v", version, err)
+		}
+		buf, err = p.Store.Get(ctx, version)
+	}
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("edmain/load dump: effdump for commit %v not found, git stash and save that version first or use -force", version)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("edmain/load dump: %v", err)
+	}
+	hdr, err := PeekHeader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, fmt.Errorf("edmain/unmarshal dump: %v", err)
+	}
+	if m := hdr.Manifest; m == nil || m.Parent == "" {
+		d, err := NewDumpReader(buf, p.Limits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("edmain/unmarshal dump: %v", err)
+		}
+		return &entryStream{version: version, d: d}, m, nil
+	}
+	kvs, m, err := p.decode(ctx, version, buf)
+	if err != nil {
+		return nil, nil, fmt.Errorf("edmain/unmarshal dump: %v", err)
+	}
+	return &entryStream{version: version, kvs: kvs}, m, nil
+}
+
+// load loads a saved version into memory.
+// If the version is missing and buildable is set then it generates the version from rev first.
+func (p *Params) load(ctx context.Context, version, rev string, buildable bool) ([]keyvalue.KV, *Manifest, error) {
+	s, m, err := p.open(ctx, version, rev, buildable)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kvs []keyvalue.KV
+	for kv, ok := s.Next(); ok; kv, ok = s.Next() {
+		kvs = append(kvs, kv)
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	return kvs, m, nil
+}
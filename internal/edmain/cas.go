@@ -0,0 +1,267 @@
+package edmain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ypsu/effdump/internal/edtextar"
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// pruner is implemented by the stores that can leave unreferenced data behind after deleting versions.
+type pruner interface {
+	// Prune deletes the unreferenced data and returns the number of the deleted items.
+	Prune(ctx context.Context) (int, error)
+}
+
+// CASStore is a content-addressed Store in a directory.
+// It stores each distinct value only once in the objects/<xx>/<rest> file where xxrest is the value's hex SHA-256.
+// Each version is a small <version>.idx file: a gzip compressed textar mapping the keys to their value's hash.
+// The index keeps the gzip header and the separator character of the saved dump so the dump can be reconstructed as is.
+// Saving a version similar to an existing one only writes the index and the new values.
+// Deleting a version only deletes its index, Prune deletes the values no index references anymore.
+// It rejects the indexes and the dumps over the limits like Uncompress.
+type CASStore struct {
+	dir    string
+	limits Limits
+}
+
+// NewCASStore returns a new CASStore storing the dumps in dir.
+// The directory is created on the first Put.
+// The zero limits are replaced with the dump's limits in Run.
+func NewCASStore(dir string, lim Limits) *CASStore { return &CASStore{dir, lim} }
+
+// String returns the directory of the store.
+func (s *CASStore) String() string { return s.dir }
+
+func (s *CASStore) path(version string) string { return filepath.Join(s.dir, version) + ".idx" }
+
+func (s *CASStore) objpath(hash string) string {
+	return filepath.Join(s.dir, "objects", hash[:2], hash[2:])
+}
+
+func contentHash(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:])
+}
+
+// maxIndexBytes returns the maximum length of an index within the limits.
+// Each entry's value is a hex SHA-256 in the index, the rest is the separator lines.
+func (s *CASStore) maxIndexBytes() int {
+	return s.limits.MaxBytes + (2*sha256.Size+16)*s.limits.MaxEntries
+}
+
+// readIndex returns the gzip header, the separator character, and the key->hash entries of version's index.
+func (s *CASStore) readIndex(version string) (gzip.Header, byte, []keyvalue.KV, error) {
+	f, err := os.Open(s.path(version))
+	if err != nil {
+		return gzip.Header{}, 0, nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return gzip.Header{}, 0, nil, fmt.Errorf("edmain/init index decompressor: %v", err)
+	}
+	limr := &io.LimitedReader{r, int64(s.maxIndexBytes() + 1)}
+	ar, err := io.ReadAll(limr)
+	if err != nil {
+		return gzip.Header{}, 0, nil, fmt.Errorf("edmain/decompress index: %v", err)
+	}
+	if limr.N == 0 {
+		return gzip.Header{}, 0, nil, fmt.Errorf("edmain/check limits: index of %s is over the limit of %d bytes", version, s.maxIndexBytes())
+	}
+	sepch := byte('=')
+	if len(ar) > 0 {
+		sepch = ar[0]
+	}
+	index := edtextar.Parse(nil, string(ar))
+	if len(index) > s.limits.MaxEntries {
+		return gzip.Header{}, 0, nil, fmt.Errorf("edmain/check limits: index of %s has %d entries, limit is %d", version, len(index), s.limits.MaxEntries)
+	}
+	return r.Header, sepch, index, nil
+}
+
+// readValue reads the value with the given hash, at most budget bytes of it.
+func (s *CASStore) readValue(hash string, budget int) (string, error) {
+	f, err := os.Open(s.objpath(hash))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	limr := &io.LimitedReader{f, int64(budget + 1)}
+	v, err := io.ReadAll(limr)
+	if err != nil {
+		return "", err
+	}
+	if limr.N == 0 {
+		return "", fmt.Errorf("edmain/check limits: dump is over the limit of %d bytes", s.limits.MaxBytes)
+	}
+	return string(v), nil
+}
+
+// Get reconstructs version's dump from its index and values.
+// It verifies each value against its hash.
+func (s *CASStore) Get(_ context.Context, version string) ([]byte, error) {
+	gzhdr, sepch, index, err := s.readIndex(version)
+	if err != nil {
+		return nil, err
+	}
+	kvs, budget := make([]keyvalue.KV, len(index)), s.limits.MaxBytes
+	for i, e := range index {
+		if len(e.V) != 2*sha256.Size {
+			return nil, fmt.Errorf("edmain/check index of %s: key %q has invalid hash %q", version, e.K, e.V)
+		}
+		if budget -= len(e.K); budget < 0 {
+			return nil, fmt.Errorf("edmain/check limits: %s is over the limit of %d bytes", version, s.limits.MaxBytes)
+		}
+		v, err := s.readValue(e.V, budget)
+		if err != nil {
+			return nil, fmt.Errorf("edmain/read value of %q: %v", e.K, err)
+		}
+		if contentHash(v) != e.V {
+			return nil, fmt.Errorf("edmain/verify value of %q: content doesn't match its hash %s", e.K, e.V)
+		}
+		kvs[i], budget = keyvalue.KV{e.K, v}, budget-len(v)
+	}
+	h, err := parseHeader(gzhdr)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/parse index header of %s: %v", version, err)
+	}
+	return Compress(kvs, sepch, h.Hash, h.Manifest, s.limits)
+}
+
+// Put stores the values of version's dump that aren't stored yet and then writes its index.
+func (s *CASStore) Put(_ context.Context, version string, data []byte) error {
+	kvs, err := Uncompress(data, s.limits)
+	if err != nil {
+		return fmt.Errorf("edmain/check dump: %v", err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("edmain/init decompressor: %v", err)
+	}
+	sepch := []byte{'='}
+	if len(kvs) > 0 {
+		if _, err := io.ReadFull(r, sepch); err != nil {
+			return fmt.Errorf("edmain/read separator: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("edmain/make dump dir: %v", err)
+	}
+	writeReadme(s.dir)
+	index := make([]keyvalue.KV, len(kvs))
+	for i, kv := range kvs {
+		hash := contentHash(kv.V)
+		index[i] = keyvalue.KV{kv.K, hash}
+		fname := s.objpath(hash)
+		if _, err := os.Stat(fname); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+			return fmt.Errorf("edmain/make objects dir: %v", err)
+		}
+		if err := writeFileAtomic(fname, []byte(kv.V)); err != nil {
+			return fmt.Errorf("edmain/write value: %v", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Header.Comment, w.Header.Extra = r.Header.Comment, r.Header.Extra
+	io.WriteString(w, edtextar.Format(index, sepch[0]))
+	w.Close()
+	if err := writeFileAtomic(s.path(version), buf.Bytes()); err != nil {
+		return fmt.Errorf("edmain/write index: %v", err)
+	}
+	return nil
+}
+
+// List returns the sorted list of versions in the directory.
+func (s *CASStore) List(context.Context) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.idx"))
+	if err != nil {
+		return nil, fmt.Errorf("edmain/glob indexes: %v", err)
+	}
+	versions := make([]string, 0, len(files))
+	for _, f := range files {
+		versions = append(versions, strings.TrimSuffix(filepath.Base(f), ".idx"))
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// Delete deletes version's index.
+// Its values remain until the next Prune.
+func (s *CASStore) Delete(_ context.Context, version string) error {
+	return os.Remove(s.path(version))
+}
+
+// ModTime returns the modification time of version's index.
+func (s *CASStore) ModTime(_ context.Context, version string) (time.Time, error) {
+	fi, err := os.Stat(s.path(version))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// Prune deletes the values that no index references.
+// Returns the number of deleted values.
+func (s *CASStore) Prune(ctx context.Context) (int, error) {
+	versions, err := s.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	for _, v := range versions {
+		_, _, index, err := s.readIndex(v)
+		if err != nil {
+			return 0, fmt.Errorf("edmain/read index of %s: %v", v, err)
+		}
+		for _, e := range index {
+			referenced[e.V] = true
+		}
+	}
+
+	objdir, pruned := filepath.Join(s.dir, "objects"), 0
+	subdirs, err := os.ReadDir(objdir)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("edmain/list objects: %v", err)
+	}
+	for _, subdir := range subdirs {
+		dir := filepath.Join(objdir, subdir.Name())
+		objects, err := os.ReadDir(dir)
+		if err != nil {
+			return pruned, fmt.Errorf("edmain/list objects: %v", err)
+		}
+		for _, obj := range objects {
+			if referenced[subdir.Name()+obj.Name()] {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, obj.Name())); err != nil {
+				return pruned, fmt.Errorf("edmain/prune object: %v", err)
+			}
+			pruned++
+		}
+		os.Remove(dir) // only succeeds if it became empty
+	}
+	os.Remove(objdir) // only succeeds if it became empty
+	return pruned, nil
+}
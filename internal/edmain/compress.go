@@ -11,73 +11,381 @@ import (
 	"github.com/ypsu/effdump/internal/keyvalue"
 )
 
-const (
-	maxEntries    int = 1e4
-	maxTotalBytes int = 1e7
-)
+// Limits bounds the size of the dumps effdump accepts.
+// They protect against running out of memory on huge or adversarial dumps.
+type Limits struct {
+	MaxEntries int // the maximum number of entries
+	MaxBytes   int // the maximum length of the uncompressed textar
+}
+
+// DefaultLimits are the limits unless the dump overrides them.
+var DefaultLimits = Limits{1e4, 1e7}
+
+// noLimits is for decoding the data effdump generated itself such as the dumps CASStore reconstructs.
+var noLimits = Limits{1 << 30, 1 << 40}
+
+// maxCompressed returns the maximum size of a compressed dump within the limits.
+// It accounts for the gzip headers, the manifest, and the checksums on top of the textar.
+func (lim Limits) maxCompressed() int {
+	return lim.MaxBytes + 20*lim.MaxEntries + 1<<20
+}
+
+// shardBytes is the target size of each shard's uncompressed textar.
+const shardBytes = 1 << 20
+
+// shardComment identifies the shard members in the compressed dumps.
+// It's followed by the 1-based index of the shard.
+const shardComment = "effdump shard"
 
 // Compress compresses `kvs` into a byte stream suitable for saving to disk.
-// It's a gzip compressed textar with sepch used as the separator character.
-// Returns an error if kvs is not sorted or encoding hit internal limits.
-func Compress(kvs []keyvalue.KV, sepch byte, hash uint64) (data []byte, err error) {
-	if len(kvs) > maxEntries {
-		// This library wasn't designed for this huge size.
-		return nil, fmt.Errorf("edmain marshal: effects count is %d K, limit is %d K", len(kvs)/1e3, maxEntries/1e3)
+// It's a sequence of gzip members, each containing a textar shard of about shardBytes with sepch used as the separator character.
+// The first member's header comment contains the entry count, the total textar length, and the hash.
+// The first member's header extra field contains the manifest in JSON in a subfield if m is not nil, see marshalManifest.
+// The rest of the shards are in members with the "effdump shard <index>" header comment.
+// A last gzip member follows the shards: it contains each entry's EntryHash in hex, one per line.
+// The manifest records its compressed length so that DumpReader finds it without decompressing the shards.
+// It doesn't check the order of kvs, the callers must pass them sorted.
+// Returns an error if kvs is over the limits.
+func Compress(kvs []keyvalue.KV, sepch byte, hash uint64, m *Manifest, lim Limits) (data []byte, err error) {
+	if len(kvs) > lim.MaxEntries {
+		return nil, fmt.Errorf("edmain/check limits: effects count is %d, limit is %d", len(kvs), lim.MaxEntries)
 	}
 	dumplen := 0
-	for i := 1; i < len(kvs); i++ {
-		dumplen += len(kvs[i].K) + len(kvs[i].V)
-		if dumplen > maxTotalBytes {
-			// This library wasn't designed for this huge size.
-			return nil, fmt.Errorf("edmain marshal: effects size is %d MB, limit is %d MB", dumplen/1e6, maxTotalBytes/1e6)
+	for _, kv := range kvs {
+		if dumplen += len(kv.K) + len(kv.V); dumplen > lim.MaxBytes {
+			return nil, fmt.Errorf("edmain/check limits: effects size is at least %d bytes, limit is %d bytes", dumplen, lim.MaxBytes)
 		}
 	}
+	shards := shardsOf(kvs)
 
-	buf := &bytes.Buffer{}
-	ar, w := edtextar.Format([]keyvalue.KV(kvs), sepch), gzip.NewWriter(buf)
-	w.Header.Comment = fmt.Sprintf("effdump %d %d %016x", len(kvs), len(ar), hash)
-	_, err = io.Copy(w, strings.NewReader(ar))
+	// The manifest records the length of the checksums member so compress it first.
+	sums := &bytes.Buffer{}
+	w := gzip.NewWriter(sums)
+	w.Header.Comment = checksumsComment
+	for _, kv := range kvs {
+		fmt.Fprintf(w, "%016x\n", EntryHash(kv))
+	}
+	w.Close()
+	if m != nil {
+		mc := *m
+		mc.ChecksumsLen, m = sums.Len(), &mc
+	}
+	extra, err := marshalManifest(m)
 	if err != nil {
+		return nil, err
+	}
+
+	// The first member's header needs the total length so compress the rest of the shards first.
+	rest, arlen := &bytes.Buffer{}, 0
+	for i, shard := range shards[1:] {
+		ar, w := edtextar.Format(shard, sepch), gzip.NewWriter(rest)
+		arlen += len(ar)
+		w.Header.Comment = fmt.Sprintf("%s %d", shardComment, i+2)
+		if _, err := io.WriteString(w, ar); err != nil {
+			return nil, fmt.Errorf("edmain/compress shard: %v", err)
+		}
+		w.Close()
+	}
+	ar := edtextar.Format(shards[0], sepch)
+	if arlen += len(ar); arlen > lim.MaxBytes {
+		return nil, fmt.Errorf("edmain/check limits: textar size is %d bytes, limit is %d bytes", arlen, lim.MaxBytes)
+	}
+
+	buf := &bytes.Buffer{}
+	w = gzip.NewWriter(buf)
+	w.Header.Comment = fmt.Sprintf("effdump %d %d %016x", len(kvs), arlen, hash)
+	w.Header.Extra = extra
+	if _, err := io.WriteString(w, ar); err != nil {
 		return nil, fmt.Errorf("edmain/compress: %v", err)
 	}
 	w.Close()
+	buf.Write(rest.Bytes())
+	buf.Write(sums.Bytes())
 	return buf.Bytes(), nil
 }
 
-// Uncompress decodes a compressed textar stream.
-// See Marshal() for info about the format.
+// shardsOf splits kvs into the shards of about shardBytes each.
+func shardsOf(kvs []keyvalue.KV) [][]keyvalue.KV {
+	var shards [][]keyvalue.KV
+	shardstart, shardlen := 0, 0
+	for i, kv := range kvs {
+		sz := len(kv.K) + len(kv.V)
+		if shardlen > 0 && shardlen+sz > shardBytes {
+			shards, shardstart, shardlen = append(shards, kvs[shardstart:i]), i, 0
+		}
+		shardlen += sz
+	}
+	return append(shards, kvs[shardstart:])
+}
+
+// textarSize returns the total length of the shards' textars Compress would write for kvs.
+// It's the size in the header of a full dump.
+func textarSize(kvs []keyvalue.KV, sepch byte) int {
+	size := 0
+	for _, shard := range shardsOf(kvs) {
+		size += len(edtextar.Format(shard, sepch))
+	}
+	return size
+}
+
+// checksumsComment identifies the checksums member in the compressed dumps.
+const checksumsComment = "effdump checksums"
+
+// readChecksums reads the checksums member r is positioned at.
+// It expects exactly one checksum per entry.
+func readChecksums(r *gzip.Reader, entries int) ([]string, error) {
+	if r.Header.Comment != checksumsComment {
+		return nil, fmt.Errorf("edmain/checksums header: got %q, want %q", r.Header.Comment, checksumsComment)
+	}
+	limr := &io.LimitedReader{r, int64(17*entries + 1)}
+	sums, err := io.ReadAll(limr)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/decompress checksums: %v", err)
+	}
+	if limr.N == 0 {
+		return nil, fmt.Errorf("edmain/checksums limit: more checksums than entries")
+	}
+	lines := strings.Fields(string(sums))
+	if len(lines) != entries {
+		return nil, fmt.Errorf("edmain/checksums count: got %d checksums for %d entries", len(lines), entries)
+	}
+	return lines, nil
+}
+
+// DumpReader decodes a compressed dump entry by entry.
+// If the manifest records the length of the checksums member then it decodes the dump in a single pass one shard at a time:
+// only the current shard's entries are in memory.
+// Otherwise it decodes the whole dump upfront.
+// See Compress() for info about the format.
+type DumpReader struct {
+	lim    Limits
+	hdr    Header
+	src    *bytes.Reader
+	r      *gzip.Reader
+	sumsAt int           // the offset of the checksums member, -1 if the manifest doesn't record it
+	budget int           // the uncompressed bytes left within the limits
+	shard  int           // the number of shards decoded so far
+	end    bool          // whether all shards are decoded
+	legacy bool          // whether the dump lacks the checksums
+	sums   []string      // the checksums of the entries, nil for the legacy dumps
+	kvs    []keyvalue.KV // the decoded entries not returned yet
+	n      int           // the number of entries returned so far
+	done   bool
+	err    error
+}
+
+// NewDumpReader returns a reader for the entries of a compressed dump.
 // The function is safe: it won't eat up all memory on adversial input or on a huge effdump.
 // It only accepts effdumps within the limits.
-func Uncompress(data []byte) ([]keyvalue.KV, error) {
-	r, err := gzip.NewReader(bytes.NewBuffer(data))
+// It reads the checksums first so that Next verifies each entry before returning it, only the dumps saved before format 2 may lack them.
+func NewDumpReader(data []byte, lim Limits) (*DumpReader, error) {
+	src := bytes.NewReader(data)
+	r, err := gzip.NewReader(src)
 	if err != nil {
 		return nil, fmt.Errorf("edmain/init decompressor: %v", err)
 	}
-	var entriesCount, textarLen int
-	fmt.Sscanf(r.Header.Comment, "effdump %d %d", &entriesCount, &textarLen)
-	if entriesCount > maxEntries || textarLen > maxTotalBytes {
-		return nil, fmt.Errorf("edmain/header check: effdump too large: entriesK=%d > %d or totalMB=%d > %d", entriesCount/1e3, maxEntries/1e3, textarLen/1e6, maxTotalBytes/1e6)
+	r.Multistream(false)
+	hdr, err := parseHeader(r.Header)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Entries > lim.MaxEntries || hdr.Size > lim.MaxBytes {
+		return nil, fmt.Errorf("edmain/header check: effdump too large: entries=%d > %d or textar bytes=%d > %d", hdr.Entries, lim.MaxEntries, hdr.Size, lim.MaxBytes)
+	}
+	d := &DumpReader{lim: lim, hdr: hdr, src: src, r: r, sumsAt: -1, budget: lim.MaxBytes}
+	if m := hdr.Manifest; m != nil && m.ChecksumsLen > 0 {
+		if m.ChecksumsLen > len(data) {
+			return nil, fmt.Errorf("edmain/checksums check: manifest says the checksums are %d bytes, the dump is %d bytes (truncated?)", m.ChecksumsLen, len(data))
+		}
+		d.sumsAt = len(data) - m.ChecksumsLen
+		sr, err := gzip.NewReader(bytes.NewReader(data[d.sumsAt:]))
+		if err != nil {
+			return nil, fmt.Errorf("edmain/init checksums decompressor: %v", err)
+		}
+		sr.Multistream(false)
+		if d.sums, err = readChecksums(sr, max(hdr.Entries, 0)); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	// The checksums follow the shards, decode all of them to get there.
+	for !d.end {
+		if err := d.readShard(); err != nil {
+			return nil, err
+		}
+	}
+	if !d.legacy {
+		if d.sums, err = readChecksums(r, max(hdr.Entries, 0)); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Header returns the metadata stored in the dump's gzip header.
+func (d *DumpReader) Header() Header { return d.hdr }
+
+// Next returns the next entry.
+// Returns false at the end of the dump or on error, see Err.
+func (d *DumpReader) Next() (keyvalue.KV, bool) {
+	for len(d.kvs) == 0 {
+		if d.done {
+			return keyvalue.KV{}, false
+		}
+		if d.end {
+			d.done = true
+			if d.n != d.hdr.Entries {
+				d.err = fmt.Errorf("edmain/entries check: header says %d entries, got %d (truncated?)", d.hdr.Entries, d.n)
+			}
+			return keyvalue.KV{}, false
+		}
+		if d.err = d.readShard(); d.err != nil {
+			d.done, d.kvs = true, nil
+			return keyvalue.KV{}, false
+		}
+	}
+	kv := d.kvs[0]
+	if !d.legacy {
+		if d.n >= len(d.sums) {
+			d.done, d.kvs, d.err = true, nil, fmt.Errorf("edmain/checksums count: more entries than the %d checksums", len(d.sums))
+			return keyvalue.KV{}, false
+		}
+		if want := fmt.Sprintf("%016x", EntryHash(kv)); d.sums[d.n] != want {
+			d.done, d.kvs, d.err = true, nil, fmt.Errorf("edmain/verify checksum: entry %d (key %q) is corrupted", d.n, kv.K)
+			return keyvalue.KV{}, false
+		}
+	}
+	d.kvs, d.n = d.kvs[1:], d.n+1
+	return kv, true
+}
+
+// Err returns the first error Next encountered.
+func (d *DumpReader) Err() error { return d.err }
+
+// readShard decodes the next shard and appends its entries to d.kvs.
+// It sets d.end instead if there are no more shards.
+func (d *DumpReader) readShard() error {
+	if d.shard >= 1 {
+		pos := int(d.src.Size()) - d.src.Len()
+		if d.sumsAt >= 0 && pos == d.sumsAt {
+			d.end = true
+			return nil
+		}
+		if d.sumsAt >= 0 && pos > d.sumsAt {
+			return fmt.Errorf("edmain/shard check: shard %d overlaps the checksums", d.shard)
+		}
+		err := d.r.Reset(d.src)
+		if m := d.hdr.Manifest; err == io.EOF && d.sumsAt < 0 && d.shard == 1 && (m == nil || m.Format < 2) {
+			d.end, d.legacy = true, true // the single shard dumps saved before the checksums were introduced end here
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("edmain/checksums check: dump ends without the checksums after shard %d (truncated?)", d.shard)
+		}
+		if err != nil {
+			return fmt.Errorf("edmain/init shard decompressor: %v", err)
+		}
+		d.r.Multistream(false)
+		if !strings.HasPrefix(d.r.Header.Comment, shardComment+" ") {
+			if d.sumsAt >= 0 {
+				return fmt.Errorf("edmain/shard header: got %q before the checksums, want %q", d.r.Header.Comment, fmt.Sprintf("%s %d", shardComment, d.shard+1))
+			}
+			d.end = true // reached the checksums
+			return nil
+		}
+		if want := fmt.Sprintf("%s %d", shardComment, d.shard+1); d.r.Header.Comment != want {
+			return fmt.Errorf("edmain/shard header: got %q, want %q", d.r.Header.Comment, want)
+		}
 	}
-	w, kvs := &strings.Builder{}, make([]keyvalue.KV, 0, entriesCount)
-	w.Grow(textarLen)
-	limr := &io.LimitedReader{r, int64(maxTotalBytes + 1)}
+	w := &strings.Builder{}
+	w.Grow(min(max(d.hdr.Size, 0), d.budget, 2*shardBytes))
+	limr := &io.LimitedReader{d.r, int64(d.budget + 1)}
 	if _, err := io.Copy(w, limr); err != nil {
-		return nil, fmt.Errorf("edmain/decompress: %v", err)
+		return fmt.Errorf("edmain/decompress: %v", err)
 	}
 	if limr.N == 0 {
-		return nil, fmt.Errorf("edmain/decompress limit: decompress reached the limit of %d MB", maxTotalBytes/1e6)
+		return fmt.Errorf("edmain/decompress limit: decompress reached the limit of %d bytes", d.lim.MaxBytes)
 	}
-	return edtextar.Parse(kvs, w.String()), nil
+	d.budget, d.shard = d.budget-w.Len(), d.shard+1
+	if d.kvs = edtextar.Parse(d.kvs, w.String()); d.n+len(d.kvs) > d.lim.MaxEntries {
+		return fmt.Errorf("edmain/decompress limit: decompress reached the limit of %d entries", d.lim.MaxEntries)
+	}
+	return nil
 }
 
-// PeekHash returns the hash stored in the gzip header.
-func PeekHash(f io.Reader) uint64 {
+// Uncompress decodes a compressed textar stream into memory.
+// See NewDumpReader for the checks and DumpReader for decoding large dumps with bounded memory.
+func Uncompress(data []byte, lim Limits) ([]keyvalue.KV, error) {
+	d, err := NewDumpReader(data, lim)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]keyvalue.KV, 0, max(d.hdr.Entries, 0))
+	for kv, ok := d.Next(); ok; kv, ok = d.Next() {
+		kvs = append(kvs, kv)
+	}
+	if err := d.Err(); err != nil {
+		return nil, err
+	}
+	return kvs, nil
+}
+
+// Header is the metadata stored in the gzip header of a compressed dump.
+type Header struct {
+	Entries  int       // the number of entries
+	Size     int       // the total length of the uncompressed textar shards
+	Hash     uint64    // the hash of the entries, see Hash(); the legacy hash in the dumps saved without a digest
+	Manifest *Manifest // nil for dumps saved without a manifest
+}
+
+// hasDigest reports whether the manifest records the digest of the entries.
+func (h Header) hasDigest() bool { return h.Manifest != nil && h.Manifest.Hash != "" }
+
+// verify checks kvs against the hashes of the header.
+// The dumps saved without a digest in the manifest may have the legacy hash in the header.
+func (h Header) verify(kvs []keyvalue.KV) error {
+	if h.hasDigest() {
+		algo, _, _ := strings.Cut(h.Manifest.Hash, ":")
+		got, err := Digest(kvs, algo)
+		if err != nil {
+			return err
+		}
+		if got != h.Manifest.Hash {
+			return fmt.Errorf("edmain/hash check: manifest says %s, got %s", h.Manifest.Hash, got)
+		}
+	}
+	if got := Hash(kvs); got != h.Hash && (h.hasDigest() || LegacyHash(kvs) != h.Hash) {
+		return fmt.Errorf("edmain/hash check: header says %016x, got %016x", h.Hash, got)
+	}
+	return nil
+}
+
+// PeekHeader returns the metadata stored in the gzip header.
+func PeekHeader(f io.Reader) (Header, error) {
 	r, err := gzip.NewReader(f)
 	if err != nil {
-		return 0
+		return Header{}, fmt.Errorf("edmain/init decompressor: %v", err)
+	}
+	return parseHeader(r.Header)
+}
+
+// parseHeader parses the metadata from a compressed dump's gzip header.
+func parseHeader(gzhdr gzip.Header) (Header, error) {
+	var h Header
+	if _, err := fmt.Sscanf(gzhdr.Comment, "effdump %d %d %x", &h.Entries, &h.Size, &h.Hash); err != nil {
+		return Header{}, fmt.Errorf("edmain/parse header %q: %v", gzhdr.Comment, err)
+	}
+	m, err := unmarshalManifest(gzhdr.Extra)
+	if err != nil {
+		return Header{}, err
 	}
-	var entriesCount, textarLen int
-	var hash uint64
-	fmt.Sscanf(r.Header.Comment, "effdump %d %d %x", &entriesCount, &textarLen, &hash)
-	return hash
+	h.Manifest = m
+	return h, nil
+}
+
+// PeekHash returns the hash stored in the gzip header.
+func PeekHash(f io.Reader) uint64 {
+	h, _ := PeekHeader(f)
+	return h.Hash
 }
@@ -15,12 +15,12 @@ func TestUncompress(t *testing.T) {
 	for i := 0; i < 7; i++ {
 		src = append(src, keyvalue.KV{fmt.Sprint(i), strings.Repeat("x", i)})
 	}
-	data, err := edmain.Compress(src, '=', edmain.Hash(src))
+	data, err := edmain.Compress(src, '=', edmain.Hash(src), nil, edmain.DefaultLimits)
 	if err != nil {
 		t.Errorf("Compress() = %v, want no error.", err)
 	}
 
-	dst, err := edmain.Uncompress(data)
+	dst, err := edmain.Uncompress(data, edmain.DefaultLimits)
 	if err != nil {
 		t.Errorf("Uncompress() = %v, want no error.", err)
 	}
@@ -28,3 +28,83 @@ func TestUncompress(t *testing.T) {
 		t.Errorf("Uncompress():\ngot: %v\nwant: %v\n", dst, src)
 	}
 }
+
+func TestUncompressSharded(t *testing.T) {
+	// 80K entries of 100 bytes each need multiple shards.
+	src := make([]keyvalue.KV, 0, 80000)
+	for i := 0; i < 80000; i++ {
+		src = append(src, keyvalue.KV{fmt.Sprintf("key%06d", i), fmt.Sprintf("%090d\n", i)})
+	}
+	lim := edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}
+	data, err := edmain.Compress(src, '=', edmain.Hash(src), nil, lim)
+	if err != nil {
+		t.Fatalf("Compress() = %v, want no error.", err)
+	}
+	if got := strings.Count(string(data), "effdump shard"); got < 2 {
+		t.Errorf("Compress() has %d shard members, want multiple.", got)
+	}
+	hdr, err := edmain.PeekHeader(strings.NewReader(string(data)))
+	if err != nil || hdr.Entries != len(src) {
+		t.Errorf("PeekHeader() = (%+v, %v), want %d entries.", hdr, err, len(src))
+	}
+
+	dst, err := edmain.Uncompress(data, lim)
+	if err != nil {
+		t.Fatalf("Uncompress() = %v, want no error.", err)
+	}
+	if !slices.Equal(src, dst) {
+		t.Errorf("Uncompress() returned %d entries, want the original %d.", len(dst), len(src))
+	}
+
+	if _, err := edmain.Compress(src, '=', edmain.Hash(src), nil, edmain.DefaultLimits); err == nil {
+		t.Errorf("Compress() with the default limits succeeded, want an error.")
+	}
+	if _, err := edmain.Uncompress(data, edmain.DefaultLimits); err == nil {
+		t.Errorf("Uncompress() with the default limits succeeded, want an error.")
+	}
+	if _, err := edmain.Uncompress(data, edmain.Limits{MaxEntries: 1e5, MaxBytes: 8e6}); err == nil {
+		t.Errorf("Uncompress() with a small byte limit succeeded, want an error.")
+	}
+}
+
+func TestDumpReader(t *testing.T) {
+	src := make([]keyvalue.KV, 0, 30000)
+	for i := 0; i < 30000; i++ {
+		src = append(src, keyvalue.KV{fmt.Sprintf("key%06d", i), fmt.Sprintf("%090d\n", i)})
+	}
+	lim := edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}
+	// Without a manifest the reader decodes the dump upfront, with one it streams the shards.
+	for _, m := range []*edmain.Manifest{nil, {Format: 7}} {
+		data, err := edmain.Compress(src, '=', edmain.Hash(src), m, lim)
+		if err != nil {
+			t.Fatalf("Compress() = %v, want no error.", err)
+		}
+
+		d, err := edmain.NewDumpReader(data, lim)
+		if err != nil {
+			t.Fatalf("NewDumpReader(manifest %v) = %v, want no error.", m, err)
+		}
+		n := 0
+		for kv, ok := d.Next(); ok; kv, ok = d.Next() {
+			if kv != src[n] {
+				t.Fatalf("Next() = %v, want %v.", kv, src[n])
+			}
+			n++
+		}
+		if err := d.Err(); err != nil || n != len(src) {
+			t.Errorf("DumpReader(manifest %v) returned %d entries and error %v, want %d entries and no error.", m, n, err, len(src))
+		}
+
+		if _, err := edmain.Uncompress(data[:len(data)-100], lim); err == nil {
+			t.Errorf("Uncompress(manifest %v) of a truncated dump succeeded, want an error.", m)
+		}
+	}
+}
+
+func TestCompressLimits(t *testing.T) {
+	// The first entry counts towards the size limit too.
+	src := []keyvalue.KV{{"a", strings.Repeat("x", 100)}}
+	if _, err := edmain.Compress(src, '=', edmain.Hash(src), nil, edmain.Limits{MaxEntries: 10, MaxBytes: 50}); err == nil {
+		t.Errorf("Compress() of a 101 byte entry with a 50 byte limit succeeded, want an error.")
+	}
+}
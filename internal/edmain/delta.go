@@ -0,0 +1,234 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// The delta dumps store only the differences to their parent version's dump.
+// They are regular dumps except:
+//
+//   - The manifest's Parent field names the parent version and its Depth is the number of deltas up to the nearest full dump.
+//   - The manifest's Entries and Size fields are the entry count and the size of the rebuilt dump, the header's are the delta's.
+//   - The entries are the added and changed entries, the manifest's Deleted field lists the deleted keys.
+//   - The header's hash and the manifest's digest are the hashes of the full, rebuilt entries so the unchanged-save check works as is.
+//
+// Reading a delta dump needs its whole chain of parents up to the nearest full dump.
+// Deleting or replacing a version rewrites its delta children as full dumps first.
+
+// maxDeltaChain bounds the chains against the cycles in corrupted stores.
+const maxDeltaChain = 1000
+
+// makeDelta returns the entries added or changed in kvs and the keys deleted from base.
+// Both kvs and base must be sorted.
+func makeDelta(base, kvs []keyvalue.KV) (changed []keyvalue.KV, deleted []string) {
+	for len(base) > 0 || len(kvs) > 0 {
+		switch {
+		case len(kvs) == 0 || len(base) > 0 && base[0].K < kvs[0].K:
+			deleted, base = append(deleted, base[0].K), base[1:]
+		case len(base) == 0 || base[0].K > kvs[0].K:
+			changed, kvs = append(changed, kvs[0]), kvs[1:]
+		default:
+			if base[0].V != kvs[0].V {
+				changed = append(changed, kvs[0])
+			}
+			base, kvs = base[1:], kvs[1:]
+		}
+	}
+	return changed, deleted
+}
+
+// applyDelta is the inverse of makeDelta: it returns base with the changed entries upserted and the deleted keys removed.
+func applyDelta(base, changed []keyvalue.KV, deleted []string) ([]keyvalue.KV, error) {
+	kvs := make([]keyvalue.KV, 0, len(base)+len(changed))
+	for len(base) > 0 || len(changed) > 0 {
+		switch {
+		case len(changed) == 0 || len(base) > 0 && base[0].K < changed[0].K:
+			if len(deleted) > 0 && deleted[0] == base[0].K {
+				deleted = deleted[1:]
+			} else {
+				kvs = append(kvs, base[0])
+			}
+			base = base[1:]
+		case len(base) == 0 || base[0].K > changed[0].K:
+			kvs, changed = append(kvs, changed[0]), changed[1:]
+		default:
+			kvs, base, changed = append(kvs, changed[0]), base[1:], changed[1:]
+		}
+	}
+	if len(deleted) > 0 {
+		return nil, fmt.Errorf("edmain/apply delta: deleted key %q is not in the parent or not in order", deleted[0])
+	}
+	return kvs, nil
+}
+
+// decode uncompresses version's dump and rebuilds the full entries if it's a delta dump.
+// Returns the dump's manifest too.
+func (p *Params) decode(ctx context.Context, version string, data []byte) ([]keyvalue.KV, *Manifest, error) {
+	hdr, err := PeekHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	kvs, err := Uncompress(data, p.Limits)
+	if err != nil {
+		return nil, nil, err
+	}
+	m := hdr.Manifest
+	if m == nil || m.Parent == "" {
+		return kvs, m, nil
+	}
+
+	// Collect the chain of deltas and then apply them from the oldest.
+	type delta struct {
+		changed []keyvalue.KV
+		deleted []string
+	}
+	chain, v, parent := []delta{{kvs, m.Deleted}}, version, m.Parent
+	for parent != "" {
+		if len(chain) > maxDeltaChain {
+			return nil, nil, fmt.Errorf("edmain/load parent of %s: delta chain is longer than %d", version, maxDeltaChain)
+		}
+		pdata, err := p.Store.Get(ctx, parent)
+		if err != nil {
+			return nil, nil, fmt.Errorf("edmain/load parent %s of %s: %v", parent, v, err)
+		}
+		phdr, err := PeekHeader(bytes.NewReader(pdata))
+		if err != nil {
+			return nil, nil, fmt.Errorf("edmain/load parent %s of %s: %v", parent, v, err)
+		}
+		pkvs, err := Uncompress(pdata, p.Limits)
+		if err != nil {
+			return nil, nil, fmt.Errorf("edmain/load parent %s of %s: %v", parent, v, err)
+		}
+		v, parent = parent, ""
+		if phdr.Manifest != nil && phdr.Manifest.Parent != "" {
+			parent = phdr.Manifest.Parent
+			chain = append(chain, delta{pkvs, phdr.Manifest.Deleted})
+		} else {
+			kvs = pkvs
+		}
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if kvs, err = applyDelta(kvs, chain[i].changed, chain[i].deleted); err != nil {
+			return nil, nil, err
+		}
+		if len(kvs) > p.Limits.MaxEntries {
+			return nil, nil, fmt.Errorf("edmain/check limits: rebuilt dump has %d entries, limit is %d", len(kvs), p.Limits.MaxEntries)
+		}
+		size := 0
+		for _, kv := range kvs {
+			size += len(kv.K) + len(kv.V)
+		}
+		if size > p.Limits.MaxBytes {
+			return nil, nil, fmt.Errorf("edmain/check limits: rebuilt dump has %d bytes, limit is %d", size, p.Limits.MaxBytes)
+		}
+	}
+	if err := hdr.verify(kvs); err != nil {
+		return nil, nil, fmt.Errorf("edmain/verify rebuilt %s: %v", version, err)
+	}
+	return kvs, m, nil
+}
+
+// compressDelta compresses the current effects as a delta against the parent revision's dump if possible.
+// Returns nil if a full dump should be saved instead: deltas are disabled, the parent is not saved, the chain is too long, or the delta is not small enough.
+func (p *Params) compressDelta(ctx context.Context, hash uint64, digest string) ([]byte, *Manifest) {
+	if p.Delta <= 0 || p.Version != "" || p.Shard != "" {
+		return nil, nil
+	}
+	parent, err := p.VSResolve(ctx, cond(p.Revision == "", "HEAD", p.Revision)+"^")
+	if err != nil || parent == p.version || !isIdentifier(parent) {
+		return nil, nil
+	}
+	data, err := p.Store.Get(ctx, parent)
+	if err != nil {
+		return nil, nil
+	}
+	base, pm, err := p.decode(ctx, parent, data)
+	if err != nil {
+		return nil, nil
+	}
+	m := p.buildManifest()
+	m.Hash, m.Parent, m.Depth = digest, parent, 1
+	if pm != nil && pm.Parent != "" {
+		m.Depth = pm.Depth + 1
+	}
+	if m.Depth > p.Delta {
+		return nil, nil
+	}
+	changed, deleted := makeDelta(base, p.Effects)
+	if 2*(len(changed)+len(deleted)) > len(p.Effects) {
+		return nil, nil
+	}
+	m.Deleted, m.Entries, m.Size = deleted, len(p.Effects), textarSize(p.Effects, p.Sepch[0])
+	buf, err := Compress(changed, p.Sepch[0], hash, m, p.Limits)
+	if err != nil {
+		return nil, nil // e.g. too many deleted keys for the manifest
+	}
+	return buf, m
+}
+
+// detach rewrites the delta dumps whose parent is about to be deleted as full dumps.
+// doomed contains the versions about to be deleted.
+// It skips and reports the children it can't rebuild, fsck reports them as corrupted anyway.
+// Returns the number of the rewritten dumps.
+func (p *Params) detach(ctx context.Context, versions []string, doomed map[string]bool) (int, error) {
+	rewritten := 0
+	for _, v := range versions {
+		if doomed[v] {
+			continue
+		}
+		data, err := p.Store.Get(ctx, v)
+		if err != nil {
+			continue // fsck reports the unreadable dumps
+		}
+		hdr, err := PeekHeader(bytes.NewReader(data))
+		if err != nil || hdr.Manifest == nil || !doomed[hdr.Manifest.Parent] {
+			continue
+		}
+		kvs, m, err := p.decode(ctx, v, data)
+		if err != nil {
+			// The chain is already broken, e.g. an ancestor is corrupted.
+			// Such a child doesn't get worse by losing its parent so don't let it block the rest.
+			fmt.Fprintf(p.Stdout, "NOTE: skipped rewriting %s as a full dump because it can't be rebuilt: %v\n", v, err)
+			continue
+		}
+		sepch := byte('=') // the dumps saved before the manifest had the separator
+		if len(m.Sepch) == 1 {
+			sepch = m.Sepch[0]
+		}
+		full := *m
+		full.Parent, full.Depth, full.Deleted, full.Entries, full.Size = "", 0, nil, 0, 0
+		buf, err := Compress(kvs, sepch, hdr.Hash, &full, noLimits)
+		if err != nil {
+			return rewritten, fmt.Errorf("edmain/marshal %s: %v", v, err)
+		}
+		if err := p.Store.Put(ctx, v, buf); err != nil {
+			return rewritten, fmt.Errorf("edmain/save %s: %v", v, err)
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// put saves data as version.
+// If it replaces an existing version then it rewrites the version's delta children as full dumps first: they wouldn't match their new parent.
+// Only the local store's versions have children: the deltas are saved against the local parents.
+func (p *Params) put(ctx context.Context, version string, data []byte) error {
+	if _, err := localStore(p.Store).Get(ctx, version); err == nil {
+		versions, err := p.Store.List(ctx)
+		if err != nil {
+			return fmt.Errorf("edmain/list: %v", err)
+		}
+		rewritten, err := p.detach(ctx, versions, map[string]bool{version: true})
+		if err != nil {
+			return fmt.Errorf("edmain/detach: %v", err)
+		}
+		if rewritten > 0 {
+			fmt.Fprintf(p.Stdout, "Rewrote %d delta dumps of the replaced %s as full dumps.\n", rewritten, version)
+		}
+	}
+	return p.Store.Put(ctx, version, data)
+}
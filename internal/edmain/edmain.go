@@ -4,7 +4,7 @@ package edmain
 import (
 	"cmp"
 	"context"
-	"errors"
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"hash/fnv"
@@ -25,6 +25,8 @@ import (
 	"github.com/ypsu/effdump/internal/edbg"
 	"github.com/ypsu/effdump/internal/edtextar"
 	"github.com/ypsu/effdump/internal/fmtdiff"
+	"github.com/ypsu/effdump/internal/git"
+	"github.com/ypsu/effdump/internal/jsondiff"
 	"github.com/ypsu/effdump/internal/keyvalue"
 
 	_ "embed"
@@ -40,20 +42,44 @@ type Params struct {
 	Flagset      *flag.FlagSet // for Usage().
 	VSHasChanges func(context.Context) (dirty bool, err error)
 	VSResolve    func(ctx context.Context, revision string) (version string, err error)
+	VSWorktree   func(ctx context.Context, revision, dir string) (workdir string, remove func() error, err error)
+	VSDescribe   func(ctx context.Context, version string) (description string, err error)
+	Store        Store
+	Now          func() time.Time                // defaults to time.Now
+	BuildInfo    func() (*debug.BuildInfo, bool) // defaults to debug.ReadBuildInfo
+	Limits       Limits                          // the zero fields default to DefaultLimits
+	DiffAlgos    []DiffAlgo                      // the per-key diff algorithms, the last matching one applies
 
 	// Flags. Must be parsed by the caller after RegisterFlags.
 	Address      string
+	Algo         string
+	Autosave     bool
 	Color        string
+	Check        string
 	ContextLines int
+	Delta        int
 	Force        bool
+	From         string
+	Golden       string
+	HashAlgo     string
+	JSON         bool
+	JSONDiff     bool
+	Keep         int
+	KeepDepth    int
 	Keyptr       string
+	MaxAge       time.Duration
+	Quarantine   bool
 	Revision     string
 	Sepch        string
 	Subkey       string
 	Template     string
+	To           string
 	Version      string
 	Watch        bool
 	RMRegexp     string
+	Shard        string
+	Shards       int
+	Similarity   float64
 
 	// Internal helper vars.
 	colorize   bool           // whether to colorize the terminal output
@@ -63,6 +89,11 @@ type Params struct {
 	filter     *regexp.Regexp // the entries to print or diff
 	rmregexp   *regexp.Regexp // the removal regexp
 	template   string         // the template value for new values
+	baserev    string         // the revision of the baseline version
+	buildable  bool           // whether the baseline can be generated from baserev if it's missing
+	baseinfo   []keyvalue.KV  // the description of the loaded versions for the diff outputs
+	toinfo     []keyvalue.KV  // the description of the -to version
+	togo       string         // the Go version of the diff's right side, empty if unknown
 	watcherpid string         // parent -watch process PID, if one is running
 }
 
@@ -78,22 +109,68 @@ Most important subcommands to know about:
 
 All subcommands:
 
+- check: Fail with the unified diff if the current version differs from the -golden file. Takes a list of key globs for filtering.
 - clear: Delete this effdump's cache: all previously stored dumps and html reports in its temp dir.
 - diff: Print an unified diff between HEAD dump and the current version. Takes a list of key globs for filtering.
 - diffkeys: List all keys with a diff. Takes a list of key globs for filtering.
+- export: Write a saved version into a textar archive file, e.g. "export v1 v1.textar". Compresses it if the file name ends with .gz, "-" prints it to stdout.
+- fsck: Verify the saved dumps and report the corrupted ones. Use -quarantine to move the corrupted dumps out of the way.
+- gc: Delete the saved dumps that no retention policy wants to keep. Configure the policies with -keep, -keepdepth, and -maxage.
 - help: This usage string.
-- hash: Prints the hash of the dump. The hash includes the key names too.
+- hash: Prints the versioned hash of the dump such as fnv2:0123456789abcdef. The hash includes the key names too. Use -hash=sha256 for a collision-resistant hash.
+  Before the versioned hashes this printed a bare hex hash such as 0123456789abcdef, use -hash=legacy to get that.
+- hashes: Print the "<hash> <key>" line of each effect. Takes a list of key globs for filtering.
+  Commit its output and use "hashes -check=<file>" to list the added, removed, and changed keys, it fails if there are any.
+  The keys with newlines or with a leading quote are Go-quoted.
 - htmldiff: Generate a HTML formatted diff between HEAD dump and the current version. Takes a list of key globs for filtering.
 - htmlprint: Similar to print but in HTML form.
+- import: Validate a textar archive file and save it as a version named after the file or after -version. Use -force to overwrite an existing version.
+- ingest: Build a version from a directory tree written by materialize, named after the directory or after -version.
 - keys: Print the list of keys the dump has.
+- materialize: Write each effect into the directory given as the argument as a file at its key's path.
+  Use -to to materialize a saved version. The directory must be empty or missing.
+  Keys are split on / into path segments and the bytes outside [A-Za-z0-9._+=,@-] are percent-encoded, e.g. "a b" becomes "a%20b".
+  The empty, ".", and ".." segments become "%", "%2E", and "%2E%2E".
+  If a key is a directory too because other keys are below it then its value is in the directory's "%%" file.
+- merge: Merge the shards saved with -shard into the version, checking for the missing shards and the duplicate keys.
+  Takes an optional list of shard dump files such as the ones collected from the CI shards,
+  otherwise it merges the version's -shards shards in the store and then removes them.
 - print: Print the dump to stdout. Takes a list of key globs for filtering.
 - printraw: Print one effect to stdout without any decoration. Needs one argument for the key.
 - save: Save the current version of the dump to the temp dir.
+  Takes an optional list of key globs: then it only replaces, adds, or removes the matching entries in the existing version and keeps the rest.
+- storeserve: Serve the dumps of all effdumps in the directory given as the argument over HTTP for EFFDUMP_REMOTE clients.
+  The directory contains a subdirectory for each effdump's saved dumps.
+- update: Rewrite the -golden file from the current version.
+- versions: List the saved versions along with their metadata. Use -json for machine-readable output.
 - webdiff: Serve the HTML formatted diff between HEAD dump and the current version. Takes a list of key globs for filtering.
 - webprintraw: Same as printraw but serves it over HTTP.
 
 Key globs: * is replaced with arbitrary number of characters. "hello" matches the glob "*o*".
 
+Use -from and -to to diff two saved versions, e.g. "diff -from=v1 -to=v2".
+Both accept a saved version or a revision, e.g. "webdiff -from=HEAD~3 -to=HEAD".
+
+Golden-file mode: with -golden the baseline is a textar file in the repository instead of the saved dumps.
+Keep it up to date with "update" and verify it in the tests or in CI with "check".
+The diff subcommands diff against it too.
+
+Delta saves: with -delta=N save stores only the changed, added, and deleted entries against the parent revision's saved dump.
+Loading such a dump rebuilds it from its parents transparently.
+A full dump is saved after N deltas in a row, when the parent isn't saved, or when most entries changed.
+gc rewrites the deltas of the removed versions as full dumps.
+
+Environment variables:
+
+- EFFDUMP_DIR: The directory for the saved dumps. Defaults to a per-user, per-dump directory in the system temp dir.
+- EFFDUMP_STORE: Where to save the dumps. Valid values: dir|cas|git. Defaults to dir.
+  dir saves the dumps into EFFDUMP_DIR.
+  cas saves into EFFDUMP_DIR too but stores each distinct value only once, saving a similar version only writes the new values.
+  git saves them as git blobs under the refs/effdump/<name>/<version> refs.
+  Share them with "git push origin 'refs/effdump/*:refs/effdump/*'" and fetch them with "git fetch origin 'refs/effdump/*:refs/effdump/*'".
+- EFFDUMP_REMOTE: The URL of a storeserve server.
+  If set, diff downloads the baseline from the server when it's missing locally, and save uploads to the server too.
+
 Flags:
 
 `))
@@ -105,17 +182,53 @@ Flags:
 func (p *Params) RegisterFlags(fs *flag.FlagSet) {
 	p.Flagset = fs
 	fs.Usage = p.Usage
-	fs.StringVar(&p.Address, "address", ":8080", "The address to serve webdiff on.")
+	fs.StringVar(&p.Address, "address", ":8080", "The address to serve webdiff and storeserve on.")
+	fs.StringVar(&p.Algo, "algo", "",
+		"The diff algorithm. Valid values: anchored|myers|patience|histogram.\n"+
+			"Overrides the per-key algorithms of the dump, otherwise defaults to anchored.")
+	fs.BoolVar(&p.Autosave, "autosave", true, "If the baseline is missing, generate it from a temporary git worktree of the baseline revision.")
+	fs.StringVar(&p.Check, "check", "", "For hashes: compare the hashes against this file written by hashes earlier and list the added, removed, and changed keys.")
 	fs.StringVar(&p.Color, "color", "auto", "Whether to colorize the output. Valid values: auto|yes|no.")
 	fs.IntVar(&p.ContextLines, "context", 3, "Print this amount of diff context.")
+	fs.IntVar(&p.Delta, "delta", p.Delta,
+		"For save: save the dump as a delta against the parent revision's saved dump if it's small.\n"+
+			"Save a full dump after this many deltas in a row to keep the chains short. 0 always saves full dumps.")
 	fs.BoolVar(&p.Force, "force", false, "Force a save even from unclean directory.")
+	fs.StringVar(&p.From, "from", "",
+		"Diff from this saved version or revision instead of the HEAD revision's dump.\n"+
+			"Tries the saved versions first and then resolves it through the version control system.")
+	fs.StringVar(&p.Golden, "golden", p.Golden,
+		"Use this textar file as the baseline instead of the saved dumps, e.g. to keep the expectations committed in the repository.\n"+
+			"Write it with the update subcommand and verify it with the check subcommand.")
+	fs.StringVar(&p.HashAlgo, "hash", HashFNV2,
+		"The hash algorithm of the hash subcommand and of the digests in the saved dumps. Valid values: fnv2|sha256|legacy.\n"+
+			"Both fnv2 and sha256 hash the length-prefixed keys and values, sha256 is collision-resistant.\n"+
+			"legacy is only for the hash subcommand: it prints the ambiguous bare hex hash that hash printed before the versioned hashes.")
+	fs.BoolVar(&p.JSON, "json", false, "For versions: print one JSON object per line instead of a table.")
+	fs.BoolVar(&p.JSONDiff, "jsondiff", false,
+		"For the diffs: also list the changes by JSON path such as .Deployments[3].MemGB for the values that are JSON objects or arrays on both sides.\n"+
+			"It ignores the key order of the objects.")
+	fs.IntVar(&p.Keep, "keep", 0, "For gc: keep this many most recently saved versions. 0 disables this policy.")
+	fs.IntVar(&p.KeepDepth, "keepdepth", 0, "For gc: keep the versions of this many latest commits reachable from HEAD or from -rev if set. 0 disables this policy.")
 	fs.StringVar(&p.Keyptr, "keyptr", "", "Print or diff keys defined by the globs in this key from the right side. Makes it possible what to diff from the source code itself.")
+	fs.DurationVar(&p.MaxAge, "maxage", 0, "For gc: keep the versions saved within this duration such as 720h. 0 disables this policy.")
+	fs.BoolVar(&p.Quarantine, "quarantine", false, "For fsck: move the corrupted dumps from the store into the quarantine subdirectory of the temp dir.")
 	fs.StringVar(&p.Revision, "rev", "", "Use a given revision's name as the version. Defaults to HEAD revision.")
 	fs.StringVar(&p.Sepch, "sepch", "=", "Use this character as the entry separator in the output textar.")
+	fs.StringVar(&p.Shard, "shard", "",
+		"For save: save only a shard of a dump generated in multiple processes, e.g. 2/4 for the third of four shards.\n"+
+			"It saves the effects of the shard by their key's hash as the <version>shard<i>of<n> version, combine the shards with the merge subcommand.")
+	fs.IntVar(&p.Shards, "shards", 0, "For merge: merge this many shards of the version from the store, i.e. the n of the shards' save -shard=i/n.")
+	fs.Float64Var(&p.Similarity, "similarity", 0,
+		"For the diffs: merge the buckets whose changed lines are at least this similar (0 to 1) into the first such bucket, e.g. 0.6.\n"+
+			"The similarity is the ratio of the common word pairs on the changed lines. 0 disables the merging.")
 	fs.StringVar(&p.Subkey, "subkey", "",
 		"Parse each value as a textar, pick subkey's value, and then operate on that section only.\n"+
 			"Especially useful for printraw to print a portion of the result.")
 	fs.StringVar(&p.Template, "template", "", "Use this key's value as the template for new entries.")
+	fs.StringVar(&p.To, "to", "",
+		"Use this saved version or revision instead of the current effects, e.g. for diffing two saved versions.\n"+
+			"Tries the saved versions first and then resolves it through the version control system.")
 	fs.StringVar(&p.Version, "version", "",
 		"Use this as the given version name.\n"+
 			"The difference to -rev is that this doesn't try resolve this through the version control system.\n"+
@@ -136,91 +249,108 @@ func isIdentifier(v string) bool {
 	return true
 }
 
-func (p *Params) cmdSave(_ context.Context) error {
+// cmdSave saves the current effects.
+// With -shard it saves only the effects of the shard.
+// If partial is set then only the effects matching the globs or -keyptr are replaced in the existing version.
+func (p *Params) cmdSave(ctx context.Context, partial bool) error {
 	if p.dirty && !p.Force {
 		return fmt.Errorf("edmain/clean check: saving from a dirty workdir not allowed unless the -force flag is set")
 	}
+	if p.Shard != "" {
+		index, count, err := ParseShard(p.Shard)
+		if err != nil {
+			return err
+		}
+		n := len(p.Effects)
+		p.Effects = slices.DeleteFunc(p.Effects, func(kv keyvalue.KV) bool { return ShardOf(kv.K, count) != index })
+		if skipped := n - len(p.Effects); skipped > 0 {
+			fmt.Fprintf(p.Stdout, "NOTE: skipped %d effects of the other shards, use InShard to avoid generating them.\n", skipped)
+		}
+	}
+	if partial {
+		if err := p.mergePartial(ctx); err != nil {
+			return err
+		}
+	}
 	hash := Hash(p.Effects)
+	digest, err := Digest(p.Effects, p.HashAlgo)
+	if err != nil {
+		return err
+	}
 
-	if err := os.MkdirAll(p.tmpdir, 0o755); err != nil {
-		return fmt.Errorf("edmain/make dump dir: %v", err)
-	}
-	readme := filepath.Join(p.tmpdir, "README")
-	if _, err := os.Stat(readme); err != nil {
-		content := `This is the effdump directory for %s.
-More info about effdump at https://github.com/ypsu/effdump.
-These files are used during development to inspect diffs.
-They can be deleted because they can be easily regenerated.
-effdump relies on a tmp reaper daemon to keep the number of files limited.
-You have that set up, right?
-Otherwise just run this regularly:
-
-	go run %q clear
-`
-		bi, _ := debug.ReadBuildInfo()
-		contentBytes := fmt.Appendf(nil, content, bi.Path, bi.Path)
-		os.WriteFile(readme, contentBytes, 0644) // ignore error, don't care for this readme
-	}
-
-	fname := filepath.Join(p.tmpdir, p.version) + ".gz"
-	if f, err := os.Open(fname); err == nil {
-		gotHash := PeekHash(f)
-		f.Close()
-		if gotHash == hash {
-			fmt.Fprintf(p.Stdout, "NOTE: skipped writing %s because it already exists and looks the same.\n", fname)
+	// Only trust the digests, the legacy hashes are ambiguous.
+	// Check the remote copy if there is a remote: the local copy might have never made it there.
+	if hdr, err := peekHeader(ctx, upstream(p.Store), p.version); err == nil {
+		if hdr.hasDigest() && hdr.verify(p.Effects) == nil {
+			fmt.Fprintf(p.Stdout, "NOTE: skipped writing %s because it already exists and looks the same.\n", p.where(p.version))
 			return nil
 		}
 	}
 
-	buf, err := Compress(p.Effects, p.Sepch[0], hash)
-	if err != nil {
-		return fmt.Errorf("edmain/marshal: %v", err)
+	buf, m := p.compressDelta(ctx, hash, digest)
+	if buf == nil {
+		full := p.buildManifest()
+		full.Hash = digest
+		if buf, err = Compress(p.Effects, p.Sepch[0], hash, full, p.Limits); err != nil {
+			return fmt.Errorf("edmain/marshal: %v", err)
+		}
+	}
+	if err := p.put(ctx, p.version, buf); err != nil {
+		return fmt.Errorf("edmain/save: %v", err)
 	}
-	if err := os.WriteFile(fname, buf, 0o644); err != nil {
-		return fmt.Errorf("edmain/save: %v", fname)
+	if m != nil {
+		fmt.Fprintf(p.Stdout, "effdump for %s saved to %s as a delta against %s.\n", p.version, p.where(p.version), m.Parent)
+		return nil
 	}
-	fmt.Fprintf(p.Stdout, "effdump for %s saved to %s.\n", p.version, fname)
+	fmt.Fprintf(p.Stdout, "effdump for %s saved to %s.\n", p.version, p.where(p.version))
 	return nil
 }
 
 // diff diffs the current version against the baseline and records the diffs.
-func (p *Params) diff() (buckets []fmtdiff.Bucket, unchanged []string, err error) {
-	fname := filepath.Join(p.tmpdir, p.version) + ".gz"
-	buf, err := os.ReadFile(fname)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		return nil, nil, fmt.Errorf("edmain/load dump: effdump for commit %v not found, git stash and save that version first or use -force", p.version)
-	}
-	if err != nil {
-		return nil, nil, fmt.Errorf("edmain/load dump: %v", err)
-	}
-	lt, err := Uncompress(buf)
-	if err != nil {
-		return nil, nil, fmt.Errorf("edmain/unmarshal dump: %v", err)
-	}
-	for i := 1; i < len(lt); i++ {
-		if lt[i].K <= lt[i-1].K {
-			return nil, nil, fmt.Errorf("edmain/sort check of %s: %dth key not in order (corrupted? re-save the version)", p.version, i)
+// It streams the baseline's entries so only the current version and the diffs need to fit into memory.
+func (p *Params) diff(ctx context.Context) (buckets []fmtdiff.Bucket, unchanged []string, err error) {
+	var base *entryStream
+	if p.Golden != "" {
+		kvs, err := p.loadGolden()
+		if err != nil {
+			return nil, nil, err
 		}
+		base, p.baseinfo = &entryStream{version: p.Golden, kvs: kvs}, p.toinfo
+	} else {
+		var m *Manifest
+		if base, m, err = p.open(ctx, p.version, p.baserev, p.buildable); err != nil {
+			return nil, nil, err
+		}
+		p.baseinfo = append(p.describeSaved("baseline", p.version, m, p.togo), p.toinfo...)
+	}
+	next := func() (lt []keyvalue.KV) {
+		for kv, ok := base.Next(); ok; kv, ok = base.Next() {
+			if p.filter.MatchString(kv.K) {
+				lt = []keyvalue.KV{kv}
+				p.subkeyize(lt)
+				return lt
+			}
+		}
+		return nil
 	}
-	lt = slices.DeleteFunc(lt, func(kv keyvalue.KV) bool { return !p.filter.MatchString(kv.K) })
-	p.subkeyize(lt)
-	rt := p.Effects
+	lt, rt := next(), p.Effects
 
 	n, e, buckets, hash2idx := 0, fmtdiff.Entry{}, []fmtdiff.Bucket{}, map[uint64]int{}
 	for len(lt) > 0 || len(rt) > 0 {
 		switch {
 		case len(rt) == 0 || len(lt) > 0 && lt[0].K < rt[0].K:
-			e = fmtdiff.Entry{lt[0].K, "deleted", andiff.Compute(lt[0].V, "", p.rmregexp)}
-			lt, n = lt[1:], n+1
+			e = fmtdiff.Entry{lt[0].K, "deleted", andiff.ComputeAlgo(p.algoOf(lt[0].K), lt[0].V, "", p.rmregexp), nil}
+			lt, n = next(), n+1
 		case len(lt) == 0 || len(rt) > 0 && lt[0].K > rt[0].K:
-			e = fmtdiff.Entry{rt[0].K, "added", andiff.Compute(p.template, rt[0].V, p.rmregexp)}
+			e = fmtdiff.Entry{rt[0].K, "added", andiff.ComputeAlgo(p.algoOf(rt[0].K), p.template, rt[0].V, p.rmregexp), nil}
 			rt, n = rt[1:], n+1
 		case lt[0].K == rt[0].K && lt[0].V == rt[0].V:
-			lt, rt, unchanged = lt[1:], rt[1:], append(unchanged, lt[0].K)
+			unchanged = append(unchanged, lt[0].K)
+			lt, rt = next(), rt[1:]
 			continue
 		default:
-			e = fmtdiff.Entry{lt[0].K, "changed", andiff.Compute(lt[0].V, rt[0].V, p.rmregexp)}
-			lt, rt, n = lt[1:], rt[1:], n+1
+			e = fmtdiff.Entry{lt[0].K, "changed", andiff.ComputeAlgo(p.algoOf(lt[0].K), lt[0].V, rt[0].V, p.rmregexp), p.jsonChanges(lt[0].V, rt[0].V)}
+			lt, rt, n = next(), rt[1:], n+1
 		}
 		idx, exists := hash2idx[e.Diff.Hash]
 		if !exists {
@@ -228,7 +358,13 @@ func (p *Params) diff() (buckets []fmtdiff.Bucket, unchanged []string, err error
 		}
 		buckets[idx].Entries = append(buckets[idx].Entries, e)
 	}
+	if err := base.Err(); err != nil {
+		return nil, nil, err
+	}
 	slices.SortFunc(buckets, func(a, b fmtdiff.Bucket) int { return cmp.Compare(a.Entries[0].Name, b.Entries[0].Name) })
+	if p.Similarity > 0 {
+		buckets = fmtdiff.Cluster(buckets, p.Similarity)
+	}
 	return buckets, unchanged, nil
 }
 
@@ -269,19 +405,54 @@ func (p *Params) Run(ctx context.Context) error {
 	if !isIdentifier(p.Name) {
 		return fmt.Errorf("edmain/check name: name %q is not a short alphanumeric identifier", p.Name)
 	}
+	if _, err := Digest(nil, p.HashAlgo); err != nil {
+		return fmt.Errorf("edmain/check -hash: %v", err)
+	}
+	if p.Algo != "" {
+		if err := andiff.CheckAlgorithm(p.Algo); err != nil {
+			return fmt.Errorf("edmain/check -algo: %v", err)
+		}
+	}
+	for _, a := range p.DiffAlgos {
+		if err := andiff.CheckAlgorithm(a.Algo); err != nil {
+			return fmt.Errorf("edmain/check diff algorithm of %s: %v", a.Filter, err)
+		}
+	}
+	if p.Similarity < 0 || p.Similarity > 1 {
+		return fmt.Errorf("edmain/check -similarity: got %g, want a value between 0 and 1", p.Similarity)
+	}
 	if len(p.Sepch) != 1 {
 		return fmt.Errorf("edmain/sepch check: flag -sepch = %q, want a string of length 1", p.Sepch)
 	}
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	if p.BuildInfo == nil {
+		p.BuildInfo = debug.ReadBuildInfo
+	}
+	if p.Limits.MaxEntries <= 0 {
+		p.Limits.MaxEntries = DefaultLimits.MaxEntries
+	}
+	if p.Limits.MaxBytes <= 0 {
+		p.Limits.MaxBytes = DefaultLimits.MaxBytes
+	}
 	if p.Color == "auto" {
 		p.colorize = isatty()
 	} else if p.Color == "yes" {
 		p.colorize = true
 	}
 	p.tmpdir = filepath.Join(os.TempDir(), fmt.Sprintf("effdump-%d-%s", os.Getuid(), p.Name))
+	storemode, remote := "dir", ""
 	for _, e := range p.Env {
 		if dir, ok := strings.CutPrefix(e, "EFFDUMP_DIR="); ok {
 			p.tmpdir = dir
 		}
+		if mode, ok := strings.CutPrefix(e, "EFFDUMP_STORE="); ok {
+			storemode = mode
+		}
+		if url, ok := strings.CutPrefix(e, "EFFDUMP_REMOTE="); ok {
+			remote = url
+		}
 		if pid, ok := strings.CutPrefix(e, "EFFDUMP_WATCHERPID="); ok {
 			p.watcherpid = pid
 			if p.Color == "auto" {
@@ -289,21 +460,95 @@ func (p *Params) Run(ctx context.Context) error {
 			}
 		}
 	}
+	if p.Store == nil {
+		switch storemode {
+		case "dir":
+			p.Store = NewDirStore(p.tmpdir)
+		case "cas":
+			p.Store = NewCASStore(p.tmpdir, p.Limits)
+		case "git":
+			p.Store = git.NewStore("", p.Name)
+		default:
+			return fmt.Errorf("edmain/check EFFDUMP_STORE: got %q, want dir, cas, or git", storemode)
+		}
+	}
+	if s, ok := p.Store.(*CASStore); ok && s.limits == (Limits{}) {
+		s.limits = p.Limits
+	}
+	if remote != "" {
+		p.Store = &remoteStore{p.Store, NewHTTPStore(remote, p.Name, p.Limits)}
+	}
 	p.dirty, err = p.VSHasChanges(ctx)
 	if err != nil {
 		return fmt.Errorf("edmain/check for changes: %v", err)
 	}
-	if p.Version == "" {
+	var subcommand string
+	var args []string
+	if len(p.Args) >= 1 {
+		subcommand, args = p.Args[0], p.Args[1:]
+	} else {
+		if p.dirty {
+			fmt.Fprintln(p.Stdout, `NOTE: subcommand not given, picking "diff" because working dir is unclean.`)
+			subcommand = "diff"
+		} else {
+			fmt.Fprintln(p.Stdout, `NOTE: subcommand not given, picking "save" because working dir is clean.`)
+			subcommand = "save"
+		}
+	}
+
+	// Check the flag conflicts before the -to version is loaded or even generated.
+	if p.HashAlgo == HashLegacy && subcommand != "hash" {
+		return fmt.Errorf("edmain/check -hash: -hash=%s can be used only with the hash subcommand", HashLegacy)
+	}
+	if subcommand == "save" && (p.From != "" || p.To != "") {
+		return fmt.Errorf("edmain/check save flags: -from and -to can't be used with save")
+	}
+	if subcommand == "update" && len(args) >= 1 {
+		return fmt.Errorf("edmain/got %d positional arguments for update, want 0", len(args))
+	}
+	if subcommand == "update" && (p.From != "" || p.To != "" || p.Keyptr != "") {
+		return fmt.Errorf("edmain/check update flags: -from, -to, and -keyptr can't be used with update")
+	}
+	if p.From != "" && p.Golden != "" {
+		return fmt.Errorf("edmain/check -from: -from can't be combined with -golden")
+	}
+	if p.From != "" {
+		if p.Version != "" || p.Revision != "" {
+			return fmt.Errorf("edmain/check -from: -from can't be combined with -rev or -version")
+		}
+		if p.version, p.baserev, err = p.resolveSaved(ctx, p.From); err != nil {
+			return fmt.Errorf("edmain/resolve -from: %v", err)
+		}
+		p.buildable = p.baserev != ""
+	} else if p.Version == "" {
 		p.version, err = p.VSResolve(ctx, p.Revision)
 		if err != nil {
 			return fmt.Errorf("edmain/resolve revision %q: %v", p.Revision, err)
 		}
+		p.baserev, p.buildable = p.Revision, true
 	} else {
 		p.version = p.Version
 	}
 	if !isIdentifier(p.version) {
 		return fmt.Errorf("edmain/check version: %q is not a short alphanumeric identifier", p.version)
 	}
+	if bi, ok := p.BuildInfo(); ok {
+		p.togo = bi.GoVersion
+	}
+	if p.To != "" {
+		version, rev, err := p.resolveSaved(ctx, p.To)
+		if err != nil {
+			return fmt.Errorf("edmain/resolve -to: %v", err)
+		}
+		effects, m, err := p.load(ctx, version, rev, rev != "")
+		if err != nil {
+			return fmt.Errorf("edmain/load -to: %v", err)
+		}
+		p.Effects, p.toinfo, p.togo = effects, p.describeSaved("target", version, m, ""), ""
+		if m != nil {
+			p.togo = m.GoVersion
+		}
+	}
 	if p.RMRegexp != "" {
 		p.rmregexp, err = regexp.Compile(p.RMRegexp)
 		if err != nil {
@@ -326,23 +571,33 @@ func (p *Params) Run(ctx context.Context) error {
 		return fmt.Errorf("edmain/check context arg: %d is out of bounds", p.ContextLines)
 	}
 
-	var subcommand string
-	var args []string
-	if len(p.Args) >= 1 {
-		subcommand, args = p.Args[0], p.Args[1:]
-	} else {
-		if p.dirty {
-			fmt.Fprintln(p.Stdout, `NOTE: subcommand not given, picking "diff" because working dir is unclean.`)
-			subcommand = "diff"
-		} else {
-			fmt.Fprintln(p.Stdout, `NOTE: subcommand not given, picking "save" because working dir is clean.`)
-			subcommand = "save"
+	if p.Shard != "" {
+		if subcommand != "save" {
+			return fmt.Errorf("edmain/check -shard: -shard only works with save")
+		}
+		index, count, err := ParseShard(p.Shard)
+		if err != nil {
+			return err
+		}
+		if p.version = shardVersion(p.version, index, count); !isIdentifier(p.version) {
+			return fmt.Errorf("edmain/check -shard: shard version %q is not a short alphanumeric identifier, use a shorter -version", p.version)
 		}
 	}
-	if subcommand == "save" && len(args) >= 1 {
-		return fmt.Errorf("edmain/got %d positional arguments for save, want 0", len(args))
+	if subcommand == "merge" && p.Shards > 0 {
+		// The last shard has the longest name.
+		if v := shardVersion(p.version, p.Shards-1, p.Shards); !isIdentifier(v) {
+			return fmt.Errorf("edmain/check -shards: shard version %q is not a short alphanumeric identifier, use a shorter -version", v)
+		}
+	}
+	if (subcommand == "check" || subcommand == "update") && p.Golden == "" {
+		return fmt.Errorf("edmain/check golden: %s needs a golden file, set it with -golden", subcommand)
+	}
+	globs := args
+	switch subcommand {
+	case "export", "import", "ingest", "materialize", "merge", "storeserve":
+		globs = nil // their args are not key globs
 	}
-	p.filter = MakeRE(args...)
+	p.filter = MakeRE(globs...)
 
 	slices.SortFunc(p.Effects, func(a, b keyvalue.KV) int { return cmp.Compare(a.K, b.K) })
 	if p.Keyptr != "" {
@@ -362,8 +617,8 @@ func (p *Params) Run(ctx context.Context) error {
 		}
 	}
 	if p.Subkey != "" {
-		if subcommand == "save" {
-			fmt.Fprintln(p.Stdout, `NOTE: ignoring -subkey for the "save" subcommand.`)
+		if subcommand == "save" || subcommand == "update" {
+			fmt.Fprintf(p.Stdout, "NOTE: ignoring -subkey for the %q subcommand.\n", subcommand)
 		} else {
 			p.subkeyize(p.Effects)
 		}
@@ -373,24 +628,45 @@ func (p *Params) Run(ctx context.Context) error {
 		return p.watch(ctx)
 	}
 
+	if subcommand == "clear" || subcommand == "gc" || subcommand == "import" || subcommand == "ingest" || subcommand == "merge" || subcommand == "save" || subcommand == "fsck" && p.Quarantine {
+		unlock, err := p.lock()
+		if err != nil {
+			return fmt.Errorf("edmain/%s: %v", subcommand, err)
+		}
+		defer unlock()
+	}
+
 	switch subcommand {
+	case "check":
+		return p.cmdCheck(ctx)
 	case "clear":
 		if len(args) > 0 {
 			return fmt.Errorf("edmain/clear: got %d args, want 0", len(args))
 		}
+		versions, err := p.Store.List(ctx)
+		if err != nil {
+			return fmt.Errorf("edmain/clear: %v", err)
+		}
 		var deletedFiles int
-		files, _ := filepath.Glob(filepath.Join(p.tmpdir, "*.gz"))
-		for _, f := range append(files, "README") {
-			if os.Remove(f) == nil { // on success
-				edbg.Printf("Deleted %s.\n", filepath.Base(f))
+		for _, v := range versions {
+			if p.Store.Delete(ctx, v) == nil { // on success
+				edbg.Printf("Deleted %s.\n", v)
 				deletedFiles++
 			}
 		}
+		if pr, ok := p.Store.(pruner); ok {
+			pruned, err := pr.Prune(ctx)
+			if err != nil {
+				return fmt.Errorf("edmain/clear prune: %v", err)
+			}
+			deletedFiles += pruned
+		}
+		os.Remove(filepath.Join(p.tmpdir, "README"))
 		os.Remove(p.tmpdir)
-		fmt.Fprintf(p.Stdout, "Removed %d files from %s.\n", deletedFiles, p.tmpdir)
+		fmt.Fprintf(p.Stdout, "Removed %d files from %v.\n", deletedFiles, p.Store)
 		return nil
 	case "diff":
-		buckets, unchanged, err := p.diff()
+		buckets, unchanged, err := p.diff(ctx)
 		if err != nil {
 			return fmt.Errorf("edmain/diff: %v", err)
 		}
@@ -398,13 +674,13 @@ func (p *Params) Run(ctx context.Context) error {
 			fmt.Fprintln(p.Stdout, "NOTE: No diffs.")
 			return nil
 		}
-		_, err = io.WriteString(p.Stdout, fmtdiff.UnifiedBuckets(buckets, unchanged, p.Sepch[0], p.ContextLines, p.colorize))
+		_, err = io.WriteString(p.Stdout, fmtdiff.UnifiedBuckets(buckets, unchanged, p.baseinfo, p.Sepch[0], p.ContextLines, p.colorize))
 		if err != nil {
 			return fmt.Errorf("edmain/write unified diff: %v", err)
 		}
 		return nil
 	case "diffkeys":
-		buckets, _, err := p.diff()
+		buckets, _, err := p.diff(ctx)
 		if err != nil {
 			return fmt.Errorf("edmain/diff: %v", err)
 		}
@@ -413,23 +689,53 @@ func (p *Params) Run(ctx context.Context) error {
 			return nil
 		}
 		for i, bucket := range buckets {
-			fmt.Fprintf(p.Stdout, "bucket %d (%d diffs):\n", i+1, len(bucket.Entries))
+			fmt.Fprintf(p.Stdout, "bucket %d (%d diffs):\n", i+1, bucket.Len())
 			for _, e := range bucket.Entries {
 				fmt.Fprintf(p.Stdout, "\t%s\n", e.Name)
 			}
+			for _, similar := range bucket.Similar {
+				for _, e := range similar.Entries {
+					fmt.Fprintf(p.Stdout, "\t%s (%.0f%% similar)\n", e.Name, 100*similar.Similarity)
+				}
+			}
 		}
 		return nil
+	case "export":
+		if len(args) != 2 {
+			return fmt.Errorf("edmain/export: got %d args, want 2", len(args))
+		}
+		return p.cmdExport(ctx, args[0], args[1])
+	case "fsck":
+		if len(args) > 0 {
+			return fmt.Errorf("edmain/fsck: got %d args, want 0", len(args))
+		}
+		return p.cmdFsck(ctx)
+	case "gc":
+		if len(args) > 0 {
+			return fmt.Errorf("edmain/gc: got %d args, want 0", len(args))
+		}
+		return p.cmdGC(ctx)
+	case "hashes":
+		return p.cmdHashes()
 	case "hash":
 		if len(args) > 0 {
 			return fmt.Errorf("edmain/hash: got %d args, want 0", len(args))
 		}
-		fmt.Fprintf(p.Stdout, "%016x\n", Hash(p.Effects))
+		if p.HashAlgo == HashLegacy {
+			fmt.Fprintf(p.Stdout, "%016x\n", LegacyHash(p.Effects))
+			return nil
+		}
+		digest, err := Digest(p.Effects, p.HashAlgo)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(p.Stdout, digest)
 		return nil
 	case "help":
 		p.Usage()
 		return nil
 	case "htmldiff":
-		buckets, unchanged, err := p.diff()
+		buckets, unchanged, err := p.diff(ctx)
 		if err != nil {
 			return fmt.Errorf("edmain/htmldiff: %v", err)
 		}
@@ -437,7 +743,7 @@ func (p *Params) Run(ctx context.Context) error {
 			fmt.Fprintln(p.Stdout, "NOTE: No diffs.")
 			return nil
 		}
-		html := fmtdiff.HTMLBuckets(buckets, unchanged, p.ContextLines)
+		html := fmtdiff.HTMLBuckets(buckets, unchanged, p.baseinfo, p.ContextLines)
 		if _, err := io.WriteString(p.Stdout, html); err != nil {
 			return fmt.Errorf("edmain/htmldiff: %v", err)
 		}
@@ -445,11 +751,28 @@ func (p *Params) Run(ctx context.Context) error {
 	case "htmlprint":
 		io.WriteString(p.Stdout, p.htmlprint())
 		return nil
+	case "import":
+		if len(args) != 1 {
+			return fmt.Errorf("edmain/import: got %d args, want 1", len(args))
+		}
+		return p.cmdImport(ctx, args[0])
+	case "ingest":
+		if len(args) != 1 {
+			return fmt.Errorf("edmain/ingest: got %d args, want 1", len(args))
+		}
+		return p.cmdIngest(ctx, args[0])
 	case "keys":
 		for _, e := range p.Effects {
 			fmt.Fprintln(p.Stdout, e.K)
 		}
 		return nil
+	case "materialize":
+		if len(args) != 1 {
+			return fmt.Errorf("edmain/materialize: got %d args, want 1", len(args))
+		}
+		return p.cmdMaterialize(args[0])
+	case "merge":
+		return p.cmdMerge(ctx, args)
 	case "print":
 		kvs := slices.Clone(p.Effects)
 		for i, e := range kvs {
@@ -471,9 +794,21 @@ func (p *Params) Run(ctx context.Context) error {
 		}
 		return fmt.Errorf("edmain/printraw: key %q not found", args[0])
 	case "save":
-		return p.cmdSave(ctx)
+		return p.cmdSave(ctx, len(args) > 0 || p.Keyptr != "")
+	case "storeserve":
+		if len(args) != 1 {
+			return fmt.Errorf("edmain/storeserve: got %d args, want 1", len(args))
+		}
+		return p.serveHandler(ctx, StoreHandler(args[0], p.Limits))
+	case "update":
+		return p.cmdUpdate()
+	case "versions":
+		if len(args) > 0 {
+			return fmt.Errorf("edmain/versions: got %d args, want 0", len(args))
+		}
+		return p.cmdVersions(ctx)
 	case "webdiff":
-		buckets, unchanged, err := p.diff()
+		buckets, unchanged, err := p.diff(ctx)
 		if err != nil {
 			return fmt.Errorf("edmain/webdiff: %v", err)
 		}
@@ -481,7 +816,7 @@ func (p *Params) Run(ctx context.Context) error {
 			fmt.Fprintln(p.Stdout, "NOTE: No diffs.")
 			return nil
 		}
-		html := fmtdiff.HTMLBuckets(buckets, unchanged, p.ContextLines)
+		html := fmtdiff.HTMLBuckets(buckets, unchanged, p.baseinfo, p.ContextLines)
 		return p.serve(ctx, html)
 	case "webprint":
 		return p.serve(ctx, p.htmlprint())
@@ -515,6 +850,10 @@ func (p *Params) serve(ctx context.Context, s string) error {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		http.ServeContent(w, req, "", t, strings.NewReader(s))
 	})
+	return p.serveHandler(ctx, handler)
+}
+
+func (p *Params) serveHandler(ctx context.Context, handler http.Handler) error {
 	listener, err := net.Listen("tcp", p.Address)
 	if err != nil {
 		return fmt.Errorf("edmain/listen on %s: %v", p.Address, err)
@@ -561,8 +900,54 @@ func MakeRE(globs ...string) *regexp.Regexp {
 	return regexp.MustCompile(expr.String())
 }
 
-// Hash hashes a keyvalue slice.
+// jsonChanges returns the structural changes between two values if -jsondiff is set.
+func (p *Params) jsonChanges(lt, rt string) []jsondiff.Change {
+	if !p.JSONDiff {
+		return nil
+	}
+	return jsondiff.Compute(lt, rt)
+}
+
+// DiffAlgo sets the diff algorithm of the keys matching Filter.
+type DiffAlgo struct {
+	Filter *regexp.Regexp
+	Algo   string
+}
+
+// algoOf returns the diff algorithm of a key: -algo if set, otherwise the last matching DiffAlgos entry's.
+// The empty result means the default andiff.Anchored.
+func (p *Params) algoOf(key string) string {
+	if p.Algo != "" {
+		return p.Algo
+	}
+	for i := len(p.DiffAlgos) - 1; i >= 0; i-- {
+		if p.DiffAlgos[i].Filter.MatchString(key) {
+			return p.DiffAlgos[i].Algo
+		}
+	}
+	return ""
+}
+
+// EntryHash hashes a single entry.
+// The key and the value are length-prefixed so that moving bytes between them changes the hash.
+func EntryHash(kv keyvalue.KV) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s%d:%s", len(kv.K), kv.K, len(kv.V), kv.V)
+	return h.Sum64()
+}
+
+// Hash hashes a keyvalue slice with FNV-64a.
+// Each key and value is length-prefixed like in EntryHash so that moving bytes between them changes the hash.
+// It's the "fnv2" hash algorithm, see Digest.
 func Hash(kvs []keyvalue.KV) uint64 {
+	h := fnv.New64a()
+	writeEntries(h, kvs)
+	return h.Sum64()
+}
+
+// LegacyHash is the hash of the dumps saved before the manifest recorded the digest.
+// It's ambiguous: it concatenates the keys and values without separators.
+func LegacyHash(kvs []keyvalue.KV) uint64 {
 	h := fnv.New64()
 	for _, kv := range kvs {
 		h.Write([]byte(kv.K))
@@ -570,3 +955,32 @@ func Hash(kvs []keyvalue.KV) uint64 {
 	}
 	return h.Sum64()
 }
+
+func writeEntries(w io.Writer, kvs []keyvalue.KV) {
+	for _, kv := range kvs {
+		fmt.Fprintf(w, "%d:%s%d:%s", len(kv.K), kv.K, len(kv.V), kv.V)
+	}
+}
+
+// The hash algorithms of Digest.
+const (
+	HashFNV2   = "fnv2"   // Hash in 16 hex digits
+	HashSHA256 = "sha256" // SHA-256 of the same length-prefixed entries as Hash
+	HashLegacy = "legacy" // LegacyHash in 16 hex digits, never recorded in the saved dumps
+)
+
+// Digest returns the versioned hash of kvs in the "<algo>:<hex>" form, e.g. "fnv2:0123456789abcdef".
+// The prefix makes the digests of different algorithms distinct.
+func Digest(kvs []keyvalue.KV, algo string) (string, error) {
+	switch algo {
+	case HashFNV2:
+		return fmt.Sprintf("%s:%016x", algo, Hash(kvs)), nil
+	case HashSHA256:
+		h := sha256.New()
+		writeEntries(h, kvs)
+		return fmt.Sprintf("%s:%x", algo, h.Sum(nil)), nil
+	case HashLegacy:
+		return fmt.Sprintf("%s:%016x", algo, LegacyHash(kvs)), nil
+	}
+	return "", fmt.Errorf("edmain/digest: unknown hash algorithm %q, want %s, %s, or %s", algo, HashFNV2, HashSHA256, HashLegacy)
+}
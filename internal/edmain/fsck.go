@@ -0,0 +1,112 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// checkDump verifies a compressed dump: its checksums, key order, and its header.
+// Returns the number of entries in the dump.
+func checkDump(data []byte, lim Limits) (int, error) {
+	hdr, err := PeekHeader(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	kvs, err := Uncompress(data, lim)
+	if err != nil {
+		return 0, err
+	}
+	if len(kvs) != hdr.Entries {
+		return 0, fmt.Errorf("edmain/entries check: header says %d entries, got %d", hdr.Entries, len(kvs))
+	}
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].K <= kvs[i-1].K {
+			return 0, fmt.Errorf("edmain/sort check: %dth key (%q) not in order", i, kvs[i].K)
+		}
+	}
+	if hdr.Manifest != nil && hdr.Manifest.Parent != "" {
+		return len(kvs), nil // the hash is the rebuilt dump's, cmdFsck verifies it
+	}
+	if err := hdr.verify(kvs); err != nil {
+		return 0, err
+	}
+	return len(kvs), nil
+}
+
+// quarantine moves version's dump from the store into the quarantine subdirectory of the temp dir.
+func (p *Params) quarantine(ctx context.Context, version string, data []byte) (string, error) {
+	dir := filepath.Join(p.tmpdir, "quarantine")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("edmain/make quarantine dir: %v", err)
+	}
+	fname := filepath.Join(dir, version+".gz")
+	if err := os.WriteFile(fname, data, 0o644); err != nil {
+		return "", fmt.Errorf("edmain/write quarantine: %v", err)
+	}
+	if err := p.Store.Delete(ctx, version); err != nil {
+		return "", fmt.Errorf("edmain/delete quarantined: %v", err)
+	}
+	return fname, nil
+}
+
+// cmdFsck verifies all the saved versions and reports the corrupted ones.
+// With -quarantine it rewrites the readable delta children of the corrupted versions as full dumps before moving the corrupted versions away.
+func (p *Params) cmdFsck(ctx context.Context) error {
+	versions, err := p.Store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("edmain/fsck list: %v", err)
+	}
+	corrupted, bad := 0, map[string][]byte{}
+	for _, v := range versions {
+		data, err := p.Store.Get(ctx, v)
+		if err != nil {
+			fmt.Fprintf(p.Stdout, "UNREADABLE %s: %v\n", v, err)
+			corrupted++
+			continue
+		}
+		n, err := checkDump(data, p.Limits)
+		if hdr, _ := PeekHeader(bytes.NewReader(data)); err == nil && hdr.Manifest != nil && hdr.Manifest.Parent != "" {
+			var kvs []keyvalue.KV
+			kvs, _, err = p.decode(ctx, v, data)
+			n = len(kvs)
+		}
+		if err == nil {
+			fmt.Fprintf(p.Stdout, "OK %s: %d entries\n", v, n)
+			continue
+		}
+		fmt.Fprintf(p.Stdout, "CORRUPTED %s: %v\n", v, err)
+		corrupted, bad[v] = corrupted+1, data
+	}
+	if p.Quarantine && len(bad) > 0 {
+		doomed := map[string]bool{}
+		for v := range bad {
+			doomed[v] = true
+		}
+		rewritten, err := p.detach(ctx, versions, doomed)
+		if err != nil {
+			return fmt.Errorf("edmain/fsck detach: %v", err)
+		}
+		if rewritten > 0 {
+			fmt.Fprintf(p.Stdout, "Rewrote %d delta dumps of the corrupted versions as full dumps.\n", rewritten)
+		}
+		for _, v := range versions {
+			if data, ok := bad[v]; ok {
+				fname, err := p.quarantine(ctx, v, data)
+				if err != nil {
+					return fmt.Errorf("edmain/quarantine %s: %v", v, err)
+				}
+				fmt.Fprintf(p.Stdout, "Moved %s to %s.\n", v, fname)
+			}
+		}
+	}
+	if corrupted > 0 {
+		return fmt.Errorf("edmain/fsck: %d of %d versions are corrupted", corrupted, len(versions))
+	}
+	fmt.Fprintf(p.Stdout, "All %d versions are OK.\n", len(versions))
+	return nil
+}
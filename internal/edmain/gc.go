@@ -0,0 +1,105 @@
+package edmain
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// versionTimes returns the save time of each version.
+// Returns an error if the store doesn't track the save times.
+func (p *Params) versionTimes(ctx context.Context, versions []string) (map[string]time.Time, error) {
+	mt, ok := p.Store.(modTimer)
+	if !ok {
+		return nil, fmt.Errorf("edmain/get save times: store %v doesn't track the save times", p.Store)
+	}
+	times := make(map[string]time.Time, len(versions))
+	for _, v := range versions {
+		t, err := mt.ModTime(ctx, v)
+		if err != nil {
+			return nil, fmt.Errorf("edmain/get save time: %v", err)
+		}
+		times[v] = t
+	}
+	return times, nil
+}
+
+// cmdGC deletes the versions that all the configured retention policies allow deleting.
+func (p *Params) cmdGC(ctx context.Context) error {
+	if p.Keep < 0 || p.KeepDepth < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("edmain/gc: -keep, -keepdepth, and -maxage must be non-negative")
+	}
+	if p.Keep == 0 && p.KeepDepth == 0 && p.MaxAge == 0 {
+		return fmt.Errorf("edmain/gc: no retention policy specified, use at least one of -keep, -keepdepth, -maxage")
+	}
+	versions, err := p.Store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("edmain/gc list: %v", err)
+	}
+
+	// Each policy marks the versions it wants to keep.
+	// A version is deleted only if no policy wants to keep it.
+	keep := map[string]bool{}
+	if p.Keep > 0 || p.MaxAge > 0 {
+		times, err := p.versionTimes(ctx, versions)
+		if err != nil {
+			return fmt.Errorf("edmain/gc: %v", err)
+		}
+		if p.Keep > 0 {
+			bytime := slices.Clone(versions)
+			slices.SortStableFunc(bytime, func(a, b string) int { return times[b].Compare(times[a]) })
+			for _, v := range bytime[:min(p.Keep, len(bytime))] {
+				keep[v] = true
+			}
+		}
+		if p.MaxAge > 0 {
+			cutoff := p.Now().Add(-p.MaxAge)
+			for _, v := range versions {
+				if times[v].After(cutoff) {
+					keep[v] = true
+				}
+			}
+		}
+	}
+	for i := 0; i < p.KeepDepth; i++ {
+		v, err := p.VSResolve(ctx, fmt.Sprintf("%s~%d", cond(p.Revision == "", "HEAD", p.Revision), i))
+		if err != nil {
+			break // reached the root of the history
+		}
+		keep[v] = true
+	}
+
+	doomed := map[string]bool{}
+	for _, v := range versions {
+		doomed[v] = !keep[v]
+	}
+	rewritten, err := p.detach(ctx, versions, doomed)
+	if err != nil {
+		return fmt.Errorf("edmain/gc detach: %v", err)
+	}
+	if rewritten > 0 {
+		fmt.Fprintf(p.Stdout, "Rewrote %d delta dumps of the removed versions as full dumps.\n", rewritten)
+	}
+
+	removed := 0
+	for _, v := range versions {
+		if keep[v] {
+			continue
+		}
+		if err := p.Store.Delete(ctx, v); err != nil {
+			return fmt.Errorf("edmain/gc delete: %v", err)
+		}
+		fmt.Fprintf(p.Stdout, "Removed %s.\n", v)
+		removed++
+	}
+	fmt.Fprintf(p.Stdout, "Removed %d of %d versions from %v.\n", removed, len(versions), p.Store)
+	if pr, ok := p.Store.(pruner); ok && removed > 0 {
+		pruned, err := pr.Prune(ctx)
+		if err != nil {
+			return fmt.Errorf("edmain/gc prune: %v", err)
+		}
+		fmt.Fprintf(p.Stdout, "Pruned %d unreferenced values.\n", pruned)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package edmain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/ypsu/effdump/internal/edtextar"
+	"github.com/ypsu/effdump/internal/fmtdiff"
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// loadGolden loads the entries of the golden file.
+func (p *Params) loadGolden() ([]keyvalue.KV, error) {
+	buf, err := os.ReadFile(p.Golden)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("edmain/load golden: golden file %s not found, run the update subcommand to create it", p.Golden)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("edmain/load golden: %v", err)
+	}
+	kvs := edtextar.Parse(nil, string(buf))
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].K <= kvs[i-1].K {
+			return nil, fmt.Errorf("edmain/sort check of %s: %dth key (%q) not in order or duplicated (edited by hand? rerun update)", p.Golden, i, kvs[i].K)
+		}
+	}
+	return kvs, nil
+}
+
+// cmdUpdate rewrites the golden file from the current effects.
+func (p *Params) cmdUpdate() error {
+	ar := edtextar.Format(p.Effects, p.Sepch[0])
+	if old, err := os.ReadFile(p.Golden); err == nil && string(old) == ar {
+		fmt.Fprintf(p.Stdout, "Golden file %s is already up to date.\n", p.Golden)
+		return nil
+	}
+	if err := writeFileAtomic(p.Golden, []byte(ar)); err != nil {
+		return fmt.Errorf("edmain/write golden: %v", err)
+	}
+	fmt.Fprintf(p.Stdout, "Updated golden file %s with %d entries.\n", p.Golden, len(p.Effects))
+	return nil
+}
+
+// cmdCheck fails with the unified diff if the current effects differ from the golden file.
+func (p *Params) cmdCheck(ctx context.Context) error {
+	buckets, unchanged, err := p.diff(ctx)
+	if err != nil {
+		return err
+	}
+	if len(buckets) == 0 {
+		fmt.Fprintf(p.Stdout, "Golden file %s is up to date.\n", p.Golden)
+		return nil
+	}
+	if _, err := io.WriteString(p.Stdout, fmtdiff.UnifiedBuckets(buckets, unchanged, p.baseinfo, p.Sepch[0], p.ContextLines, p.colorize)); err != nil {
+		return fmt.Errorf("edmain/write unified diff: %v", err)
+	}
+	n := 0
+	for _, b := range buckets {
+		n += b.Len()
+	}
+	return fmt.Errorf("edmain/check: %d effects differ from golden file %s, run the update subcommand to accept them", n, p.Golden)
+}
@@ -0,0 +1,113 @@
+package edmain
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// The hashes subcommand prints one "<digest> <key>" line per effect where digest is the Digest of the single entry.
+// The keys that contain a newline or start with a quote are Go-quoted.
+
+// hashLine formats an effect's line for the hashes subcommand.
+func hashLine(kv keyvalue.KV, algo string) (string, error) {
+	digest, err := Digest([]keyvalue.KV{kv}, algo)
+	if err != nil {
+		return "", err
+	}
+	return digest + " " + quoteKey(kv.K), nil
+}
+
+func quoteKey(key string) string {
+	if strings.Contains(key, "\n") || strings.HasPrefix(key, `"`) {
+		return strconv.Quote(key)
+	}
+	return key
+}
+
+// parseHashes parses the output of the hashes subcommand into a key->digest map.
+func parseHashes(fname string) (map[string]string, error) {
+	buf, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/read hashes: %v", err)
+	}
+	hashes := map[string]string{}
+	for i, line := range strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		digest, key, ok := strings.Cut(line, " ")
+		if !ok || !strings.Contains(digest, ":") {
+			return nil, fmt.Errorf("edmain/parse hashes: line %d of %s is not in the <hash> <key> form", i+1, fname)
+		}
+		if strings.HasPrefix(key, `"`) {
+			if key, err = strconv.Unquote(key); err != nil {
+				return nil, fmt.Errorf("edmain/parse hashes: line %d of %s: unquote key: %v", i+1, fname, err)
+			}
+		}
+		if _, dup := hashes[key]; dup {
+			return nil, fmt.Errorf("edmain/parse hashes: line %d of %s: key %q duplicated", i+1, fname, key)
+		}
+		hashes[key] = digest
+	}
+	return hashes, nil
+}
+
+// cmdHashes prints the per-key hashes of the effects or compares them against the -check file.
+// Run already dropped the effects the globs or -keyptr don't match.
+func (p *Params) cmdHashes() error {
+	if p.Check == "" {
+		for _, kv := range p.Effects {
+			line, err := hashLine(kv, p.HashAlgo)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(p.Stdout, line)
+		}
+		return nil
+	}
+
+	want, err := parseHashes(p.Check)
+	if err != nil {
+		return err
+	}
+	var added, removed, changed int
+	for _, kv := range p.Effects {
+		digest, ok := want[kv.K]
+		if !ok {
+			fmt.Fprintf(p.Stdout, "added: %s\n", quoteKey(kv.K))
+			added++
+			continue
+		}
+		delete(want, kv.K)
+		algo, _, _ := strings.Cut(digest, ":")
+		got, err := Digest([]keyvalue.KV{kv}, algo)
+		if err != nil {
+			return fmt.Errorf("edmain/hashes check of %q: %v", kv.K, err)
+		}
+		if got != digest {
+			fmt.Fprintf(p.Stdout, "changed: %s\n", quoteKey(kv.K))
+			changed++
+		}
+	}
+	var missing []string
+	for key := range want {
+		if p.filter.MatchString(key) {
+			missing = append(missing, key)
+		}
+	}
+	slices.Sort(missing)
+	for _, key := range missing {
+		fmt.Fprintf(p.Stdout, "removed: %s\n", quoteKey(key))
+	}
+	removed = len(missing)
+	if added+removed+changed > 0 {
+		return fmt.Errorf("edmain/hashes check: %d added, %d removed, %d changed keys compared to %s", added, removed, changed, p.Check)
+	}
+	fmt.Fprintf(p.Stdout, "All %d hashes match %s.\n", len(p.Effects), p.Check)
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package edmain
+
+// lockDir is a no-op: the advisory locking is only supported on unix.
+func lockDir(string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package edmain
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive advisory lock on dir, waiting for the other effdump processes holding it.
+// Returns the function releasing the lock.
+func lockDir(dir string) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/open lock dir: %v", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		fmt.Fprintf(os.Stderr, "NOTE: waiting for another effdump process to release the lock on %s...\n", dir)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("edmain/lock %s: %v", dir, err)
+	}
+	return func() { f.Close() }, nil // closing the file releases the lock
+}
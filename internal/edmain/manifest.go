@@ -0,0 +1,159 @@
+package edmain
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// formatVersion is the version of the saved dump format.
+// Bump it whenever the format changes in a way that affects the readers.
+//
+//   - 1: gzip compressed textar.
+//   - 2: a second gzip member with per-entry checksums follows the textar.
+//   - 3: the textar is split into shards, each in its own gzip member. The single-shard dumps are the same as in 2.
+//   - 4: the dumps with a parent in the manifest are deltas, see delta.go. The full dumps are the same as in 3.
+//   - 5: the manifest records the digest of the entries and the header's hash is the length-prefixed Hash instead of the legacy one.
+//   - 6: the manifest is in a subfield of the gzip header's extra field instead of being the whole extra field.
+//   - 7: the manifest records the compressed length of the checksums member so the readers can verify the entries in a single pass.
+const formatVersion = 7
+
+// Manifest describes how a dump was saved.
+// It's stored as JSON in the manifestID subfield of the gzip header's extra field of the saved dump.
+type Manifest struct {
+	Format       int       `json:"format"`
+	SaveTime     time.Time `json:"saveTime"`
+	GoVersion    string    `json:"goVersion,omitempty"`
+	Module       string    `json:"module,omitempty"` // the main module's path@version
+	Package      string    `json:"package,omitempty"`
+	Tags         string    `json:"tags,omitempty"`
+	Dirty        bool      `json:"dirty,omitempty"`
+	Force        bool      `json:"force,omitempty"`
+	Flags        []string  `json:"flags,omitempty"`
+	Sepch        string    `json:"sepch,omitempty"`        // the textar separator character, detach uses it to rewrite the deltas
+	Hash         string    `json:"hash,omitempty"`         // the digest of the entries, see Digest; empty before format 5
+	Shard        string    `json:"shard,omitempty"`        // the i/n shard spec of the dumps saved with -shard
+	Imported     string    `json:"imported,omitempty"`     // the source archive's or directory's name for the imported dumps
+	Parent       string    `json:"parent,omitempty"`       // the parent version of the delta dumps
+	Depth        int       `json:"depth,omitempty"`        // the number of deltas up to the nearest full dump
+	Deleted      []string  `json:"deleted,omitempty"`      // the keys the delta deletes from its parent
+	Entries      int       `json:"entries,omitempty"`      // the number of the rebuilt entries of the delta dumps
+	Size         int       `json:"size,omitempty"`         // the header's size of the rebuilt entries of the delta dumps
+	ChecksumsLen int       `json:"checksumsLen,omitempty"` // the compressed length of the trailing checksums member; 0 before format 7
+}
+
+// buildManifest describes the current save.
+func (p *Params) buildManifest() *Manifest {
+	m := &Manifest{
+		Format:   formatVersion,
+		SaveTime: p.Now().UTC(),
+		Dirty:    p.dirty,
+		Force:    p.Force,
+		Flags:    []string{"-sepch=" + p.Sepch},
+		Sepch:    p.Sepch,
+		Shard:    p.Shard,
+	}
+	if bi, ok := p.BuildInfo(); ok {
+		m.GoVersion, m.Module, m.Package = bi.GoVersion, bi.Main.Path+"@"+bi.Main.Version, bi.Path
+		for _, setting := range bi.Settings {
+			if setting.Key == "-tags" {
+				m.Tags = setting.Value
+			}
+		}
+	}
+	return m
+}
+
+// manifestID is the SI1 and SI2 ID of the manifest's subfield in the gzip header's extra field.
+// RFC 1952 requires the extra field to be a list of subfields: the 2 byte ID, the 2 byte little-endian length, and the data.
+const manifestID = "ED"
+
+// marshalManifest returns the gzip header's extra field for m.
+func marshalManifest(m *Manifest) ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/marshal manifest: %v", err)
+	}
+	if len(js) > 0xffff-4 {
+		return nil, fmt.Errorf("edmain/check manifest: manifest is %d bytes, gzip header limit is 64 KB", len(js))
+	}
+	return append([]byte{manifestID[0], manifestID[1], byte(len(js)), byte(len(js) >> 8)}, js...), nil
+}
+
+// unmarshalManifest parses the manifest from the gzip header's extra field.
+// The dumps saved before format 6 have the JSON as the whole extra field.
+// Returns nil for the dumps saved without a manifest.
+func unmarshalManifest(extra []byte) (*Manifest, error) {
+	js := extra
+	if len(extra) > 0 && extra[0] != '{' {
+		js = nil
+		for len(extra) > 0 {
+			if len(extra) < 4 {
+				return nil, fmt.Errorf("edmain/parse extra field: truncated subfield header")
+			}
+			id, n := string(extra[:2]), int(extra[2])|int(extra[3])<<8
+			if len(extra) < 4+n {
+				return nil, fmt.Errorf("edmain/parse extra field: subfield %q has %d bytes, want %d", id, len(extra)-4, n)
+			}
+			if id == manifestID {
+				js = extra[4 : 4+n]
+			}
+			extra = extra[4+n:]
+		}
+	}
+	if len(js) == 0 {
+		return nil, nil
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(js, m); err != nil {
+		return nil, fmt.Errorf("edmain/unmarshal manifest: %v", err)
+	}
+	return m, nil
+}
+
+// describeSaved returns a saved version's manifest as an info entry for the diff outputs.
+// role is either baseline or target, the left or right side of the diff.
+// It highlights the properties that might make the diff misleading such as a Go version different from othergo.
+// Returns nil if the version has no manifest.
+func (p *Params) describeSaved(role, version string, m *Manifest, othergo string) []keyvalue.KV {
+	if m == nil {
+		return nil
+	}
+	w := &strings.Builder{}
+	if m.Dirty {
+		fmt.Fprintf(w, "NOTE: %s was saved from a dirty workdir%s.\n", role, cond(m.Force, " with -force", ""))
+	}
+	if othergo != "" && m.GoVersion != "" && m.GoVersion != othergo {
+		fmt.Fprintf(w, "NOTE: %s was built with %s, the other side is from %s.\n", role, m.GoVersion, othergo)
+	}
+	fmt.Fprintf(w, "saved: %s\n", m.SaveTime.Format(time.RFC3339))
+	if m.Imported != "" {
+		fmt.Fprintf(w, "imported: %s\n", m.Imported)
+	}
+	if m.Shard != "" {
+		fmt.Fprintf(w, "shard: %s\n", m.Shard)
+	}
+	if m.Parent != "" {
+		fmt.Fprintf(w, "delta: of %s, depth %d\n", m.Parent, m.Depth)
+	}
+	fmt.Fprintf(w, "go: %s\n", m.GoVersion)
+	fmt.Fprintf(w, "module: %s\n", m.Module)
+	fmt.Fprintf(w, "package: %s\n", m.Package)
+	if m.Tags != "" {
+		fmt.Fprintf(w, "tags: %s\n", m.Tags)
+	}
+	fmt.Fprintf(w, "dirty: %t\n", m.Dirty)
+	fmt.Fprintf(w, "force: %t\n", m.Force)
+	fmt.Fprintf(w, "flags: %s\n", strings.Join(m.Flags, " "))
+	if m.Hash != "" {
+		fmt.Fprintf(w, "hash: %s\n", m.Hash)
+	}
+	fmt.Fprintf(w, "format: %d\n", m.Format)
+	return []keyvalue.KV{{"(" + role + " " + version + ")", w.String()}}
+}
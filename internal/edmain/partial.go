@@ -0,0 +1,52 @@
+package edmain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// mergePartial merges the effects matching the save globs or -keyptr into the existing version.
+// It replaces p.Effects with the merged entries: the existing entries not matching the globs are kept, the matching ones are replaced by the current effects.
+func (p *Params) mergePartial(ctx context.Context) error {
+	data, err := p.Store.Get(ctx, p.version)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("edmain/partial save: %s doesn't exist yet, save the full version first", p.where(p.version))
+	}
+	if err != nil {
+		return fmt.Errorf("edmain/load %s: %v", p.version, err)
+	}
+	old, _, err := p.decode(ctx, p.version, data)
+	if err != nil {
+		return fmt.Errorf("edmain/unmarshal %s: %v", p.version, err)
+	}
+
+	var replaced, added, removed, unchanged, kept int
+	merged, cur := make([]keyvalue.KV, 0, len(old)+len(p.Effects)), p.Effects
+	for len(old) > 0 || len(cur) > 0 {
+		switch {
+		case len(cur) == 0 || len(old) > 0 && old[0].K < cur[0].K:
+			if p.filter.MatchString(old[0].K) {
+				removed++
+			} else {
+				merged, kept = append(merged, old[0]), kept+1
+			}
+			old = old[1:]
+		case len(old) == 0 || old[0].K > cur[0].K:
+			merged, cur, added = append(merged, cur[0]), cur[1:], added+1
+		default:
+			if old[0].V == cur[0].V {
+				unchanged++
+			} else {
+				replaced++
+			}
+			merged, old, cur = append(merged, cur[0]), old[1:], cur[1:]
+		}
+	}
+	fmt.Fprintf(p.Stdout, "Partial save: replaced %d, added %d, removed %d, unchanged %d matching entries; kept %d other entries.\n", replaced, added, removed, unchanged, kept)
+	p.Effects = merged
+	return nil
+}
@@ -0,0 +1,222 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HTTPStore is a Store backed by a storeserve server.
+// It stores the dumps at <url>/<name>/<version>.gz.
+type HTTPStore struct {
+	url    string
+	limits Limits
+}
+
+// NewHTTPStore returns a new HTTPStore for the name effdump on the url server.
+// It rejects the responses larger than what the limits allow.
+func NewHTTPStore(url, name string, lim Limits) *HTTPStore {
+	return &HTTPStore{strings.TrimSuffix(url, "/") + "/" + name + "/", lim}
+}
+
+// String returns the URL prefix of the dumps.
+func (s *HTTPStore) String() string { return s.url }
+
+// headerBytes is enough bytes from the start of a dump to contain its gzip header with the manifest.
+const headerBytes = 1 << 17
+
+// do sends a request to the server and returns the response's body.
+// If prefix is positive then it requests and returns only the first prefix bytes of the response.
+func (s *HTTPStore) do(ctx context.Context, method, path string, body []byte, prefix int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("edmain/make request: %v", err)
+	}
+	limit := s.limits.maxCompressed()
+	if prefix > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", prefix-1))
+		limit = prefix
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("edmain/%s %s: %v", method, s.url+path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(limit+1)))
+	if err != nil {
+		return nil, fmt.Errorf("edmain/read %s response: %v", s.url+path, err)
+	}
+	if prefix > 0 && len(data) > prefix {
+		data = data[:prefix] // the server ignored the range
+	} else if len(data) > limit {
+		return nil, fmt.Errorf("edmain/%s %s: response over the limit of %d bytes", method, s.url+path, limit)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("edmain/%s %s: %w", method, s.url+path, fs.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK && (prefix == 0 || resp.StatusCode != http.StatusPartialContent) {
+		return nil, fmt.Errorf("edmain/%s %s: %s: %s", method, s.url+path, resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// Get downloads version's dump.
+func (s *HTTPStore) Get(ctx context.Context, version string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, version+".gz", nil, 0)
+}
+
+// PeekHeader downloads only the start of version's dump with a range request and returns its header.
+func (s *HTTPStore) PeekHeader(ctx context.Context, version string) (Header, error) {
+	data, err := s.do(ctx, http.MethodGet, version+".gz", nil, headerBytes)
+	if err != nil {
+		return Header{}, err
+	}
+	return PeekHeader(bytes.NewReader(data))
+}
+
+// Put uploads version's dump.
+// It rejects the dumps the server would reject for being over the limits.
+func (s *HTTPStore) Put(ctx context.Context, version string, data []byte) error {
+	if len(data) > s.limits.maxCompressed() {
+		return fmt.Errorf("edmain/put %s%s.gz: dump is %d bytes, over the limit of %d bytes", s.url, version, len(data), s.limits.maxCompressed())
+	}
+	_, err := s.do(ctx, http.MethodPut, version+".gz", data, 0)
+	return err
+}
+
+// List returns the versions available on the server.
+func (s *HTTPStore) List(ctx context.Context) ([]string, error) {
+	data, err := s.do(ctx, http.MethodGet, "", nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// Delete is not supported: the server is meant to be append-only for its clients.
+func (s *HTTPStore) Delete(_ context.Context, version string) error {
+	return fmt.Errorf("edmain/delete %s%s.gz: deleting from a remote store is not supported", s.url, version)
+}
+
+// remoteStore uses a local store as a cache for a remote store.
+// Get falls back to the remote if the version is missing locally.
+// Put writes to both.
+// List and Delete operate on the local store only.
+type remoteStore struct {
+	local  Store
+	remote *HTTPStore
+}
+
+// upstream returns the store with the authoritative copy of the versions: the remote store if store has one.
+func upstream(store Store) Store {
+	if s, ok := store.(*remoteStore); ok {
+		return s.remote
+	}
+	return store
+}
+
+func (s *remoteStore) String() string { return fmt.Sprintf("%v (remote %v)", s.local, s.remote) }
+
+func (s *remoteStore) Get(ctx context.Context, version string) ([]byte, error) {
+	data, err := s.local.Get(ctx, version)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	data, err = s.remote.Get(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := Uncompress(data, s.remote.limits); err != nil {
+		return nil, fmt.Errorf("edmain/check remote %s: %v", version, err)
+	}
+	if err := s.local.Put(ctx, version, data); err != nil {
+		return nil, fmt.Errorf("edmain/cache remote %s: %v", version, err)
+	}
+	return data, nil
+}
+
+func (s *remoteStore) Put(ctx context.Context, version string, data []byte) error {
+	if err := s.local.Put(ctx, version, data); err != nil {
+		return err
+	}
+	return s.remote.Put(ctx, version, data)
+}
+
+func (s *remoteStore) List(ctx context.Context) ([]string, error) { return s.local.List(ctx) }
+
+func (s *remoteStore) Delete(ctx context.Context, version string) error {
+	return s.local.Delete(ctx, version)
+}
+
+func (s *remoteStore) ModTime(ctx context.Context, version string) (time.Time, error) {
+	mt, ok := s.local.(modTimer)
+	if !ok {
+		return time.Time{}, fmt.Errorf("edmain/get save time: store %v doesn't track the save times", s.local)
+	}
+	return mt.ModTime(ctx, version)
+}
+
+// StoreHandler serves the dumps in dir over HTTP for HTTPStore clients.
+// It rejects the uploads over the limits.
+// Each effdump's dumps are in the <dir>/<name> subdirectory, see DirStore.
+// The supported requests:
+//
+//   - GET /<name>/: list the versions, one per line.
+//   - GET /<name>/<version>.gz: download a dump, supports range requests.
+//   - PUT /<name>/<version>.gz: upload a dump.
+func StoreHandler(dir string, lim Limits) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, file, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		version, isgz := strings.CutSuffix(file, ".gz")
+		if !isIdentifier(name) || file != "" && (!isgz || !isIdentifier(version)) {
+			http.Error(w, "invalid path, want /<name>/ or /<name>/<version>.gz", http.StatusBadRequest)
+			return
+		}
+		ctx, store := req.Context(), NewDirStore(filepath.Join(dir, name))
+		switch {
+		case req.Method == http.MethodGet && file == "":
+			versions, err := store.List(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, v := range versions {
+				fmt.Fprintln(w, v)
+			}
+		case req.Method == http.MethodGet:
+			data, err := store.Get(ctx, version)
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "version not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data)) // supports the range requests of PeekHeader
+		case req.Method == http.MethodPut && file != "":
+			data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, int64(lim.maxCompressed())))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := Uncompress(data, lim); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := store.Put(ctx, version, data); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
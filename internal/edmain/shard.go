@@ -0,0 +1,180 @@
+package edmain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// ParseShard parses a "i/n" shard spec where 0 <= i < n.
+// The empty spec means no sharding: it returns 0 and 1.
+func ParseShard(spec string) (index, count int, err error) {
+	if spec == "" {
+		return 0, 1, nil
+	}
+	var rest string
+	if n, _ := fmt.Sscanf(spec, "%d/%d%s", &index, &count, &rest); n != 2 || count < 1 || index < 0 || index >= count {
+		return 0, 1, fmt.Errorf("edmain/parse shard: got %q, want i/n where 0 <= i < n", spec)
+	}
+	return index, count, nil
+}
+
+// ShardOf returns which of the n shards the key belongs to based on its FNV-64a hash.
+func ShardOf(key string, n int) int {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	return int(h.Sum64() % uint64(n))
+}
+
+// shardVersion is the version name of a shard's dump.
+func shardVersion(version string, index, count int) string {
+	return fmt.Sprintf("%sshard%dof%d", version, index, count)
+}
+
+// mergeShard is a shard's dump for merge.
+type mergeShard struct {
+	name         string
+	index, count int
+	kvs          []keyvalue.KV
+}
+
+// loadShard loads a shard's dump: a shard dump file if file is set, otherwise the saved version.
+func (p *Params) loadShard(ctx context.Context, version, file string) (mergeShard, error) {
+	s := mergeShard{name: version}
+	var data []byte
+	var err error
+	if file != "" {
+		s.name = file
+		data, err = os.ReadFile(file)
+	} else {
+		data, err = p.Store.Get(ctx, version)
+	}
+	if err != nil {
+		return s, fmt.Errorf("edmain/load shard: %w", err)
+	}
+	kvs, m, err := p.decode(ctx, s.name, data)
+	if err != nil {
+		return s, fmt.Errorf("edmain/unmarshal shard %s: %v", s.name, err)
+	}
+	if m == nil || m.Shard == "" {
+		return s, fmt.Errorf("edmain/check shard %s: not saved with save -shard", s.name)
+	}
+	if s.index, s.count, err = ParseShard(m.Shard); err != nil {
+		return s, fmt.Errorf("edmain/check shard %s: %v", s.name, err)
+	}
+	s.kvs = kvs
+	return s, nil
+}
+
+// cmdMerge merges the shard dumps into a single version.
+// It checks that each key is in the shard its hash belongs to.
+// files are the shard dump files such as the ones collected from the CI shards.
+// Without files it merges the p.Shards shards of the version saved into the store and then deletes them.
+// It fetches the shards by name so that the remote store's shards are found too.
+func (p *Params) cmdMerge(ctx context.Context, files []string) error {
+	if p.dirty && !p.Force {
+		return fmt.Errorf("edmain/clean check: saving from a dirty workdir not allowed unless the -force flag is set")
+	}
+	var shards []mergeShard
+	if len(files) > 0 {
+		for _, f := range files {
+			s, err := p.loadShard(ctx, "", f)
+			if err != nil {
+				return err
+			}
+			shards = append(shards, s)
+		}
+	} else {
+		if p.Shards < 1 {
+			return fmt.Errorf("edmain/merge: set the number of shards to merge from the store with -shards=n")
+		}
+		for i := 0; i < p.Shards; i++ {
+			s, err := p.loadShard(ctx, shardVersion(p.version, i, p.Shards), "")
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // reported as missing below
+			}
+			if err != nil {
+				return err
+			}
+			shards = append(shards, s)
+		}
+		if len(shards) == 0 {
+			return fmt.Errorf("edmain/merge: no shards of %s found in %v, save them with save -shard=i/%d", p.version, p.Store, p.Shards)
+		}
+	}
+
+	count, seen := shards[0].count, map[int]string{}
+	for _, s := range shards {
+		if s.count != count {
+			return fmt.Errorf("edmain/check shards: %s is a shard of %d but %s is a shard of %d", s.name, s.count, shards[0].name, count)
+		}
+		if other, dup := seen[s.index]; dup {
+			return fmt.Errorf("edmain/check shards: both %s and %s are shard %d", other, s.name, s.index)
+		}
+		seen[s.index] = s.name
+	}
+	var missing []string
+	for i := 0; i < count; i++ {
+		if _, ok := seen[i]; !ok {
+			missing = append(missing, fmt.Sprint(i))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("edmain/check shards: missing shards %s of %d", strings.Join(missing, ", "), count)
+	}
+
+	type shardKV struct {
+		keyvalue.KV
+		shard string
+	}
+	var all []shardKV
+	for _, s := range shards {
+		for _, kv := range s.kvs {
+			if i := ShardOf(kv.K, s.count); i != s.index {
+				return fmt.Errorf("edmain/check shards: key %q of %s belongs to shard %d, not %d (saved without the -shard filtering?)", kv.K, s.name, i, s.index)
+			}
+			all = append(all, shardKV{kv, s.name})
+		}
+	}
+	slices.SortStableFunc(all, func(a, b shardKV) int { return strings.Compare(a.K, b.K) })
+	kvs := make([]keyvalue.KV, len(all))
+	for i, e := range all {
+		if i > 0 && e.K == all[i-1].K {
+			return fmt.Errorf("edmain/unique check: key %q is in both %s and %s", e.K, all[i-1].shard, e.shard)
+		}
+		kvs[i] = e.KV
+	}
+
+	digest, err := Digest(kvs, p.HashAlgo)
+	if err != nil {
+		return err
+	}
+	m := p.buildManifest()
+	m.Hash = digest
+	buf, err := Compress(kvs, p.Sepch[0], Hash(kvs), m, p.Limits)
+	if err != nil {
+		return fmt.Errorf("edmain/marshal: %v", err)
+	}
+	if err := p.put(ctx, p.version, buf); err != nil {
+		return fmt.Errorf("edmain/save: %v", err)
+	}
+	fmt.Fprintf(p.Stdout, "Merged %d shards (%d entries) into %s.\n", count, len(kvs), p.where(p.version))
+	if len(files) > 0 {
+		return nil
+	}
+	for _, s := range shards {
+		if err := p.Store.Delete(ctx, s.name); err != nil {
+			return fmt.Errorf("edmain/merge delete: %v", err)
+		}
+	}
+	fmt.Fprintf(p.Stdout, "Removed the %d merged shards from %v.\n", len(shards), p.Store)
+	return nil
+}
@@ -0,0 +1,211 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Store stores compressed dumps by their version.
+// See effdump.Store for the details.
+type Store interface {
+	Get(ctx context.Context, version string) (data []byte, err error)
+	Put(ctx context.Context, version string, data []byte) error
+	List(ctx context.Context) (versions []string, err error)
+	Delete(ctx context.Context, version string) error
+}
+
+// modTimer is implemented by the stores that track when each version was saved.
+type modTimer interface {
+	ModTime(ctx context.Context, version string) (time.Time, error)
+}
+
+// headerPeeker is implemented by the stores that can read a dump's header without fetching the whole dump.
+type headerPeeker interface {
+	PeekHeader(ctx context.Context, version string) (Header, error)
+}
+
+// peekHeader returns the header of version's dump in store.
+// It fetches only the header if the store supports it.
+func peekHeader(ctx context.Context, store Store, version string) (Header, error) {
+	if hp, ok := store.(headerPeeker); ok {
+		return hp.PeekHeader(ctx, version)
+	}
+	data, err := store.Get(ctx, version)
+	if err != nil {
+		return Header{}, err
+	}
+	return PeekHeader(bytes.NewReader(data))
+}
+
+// DirStore stores each dump as a <version>.gz file in a directory.
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore returns a new DirStore storing the dumps in dir.
+// The directory is created on the first Put.
+func NewDirStore(dir string) *DirStore { return &DirStore{dir} }
+
+// String returns the directory of the store.
+func (s *DirStore) String() string { return s.dir }
+
+func (s *DirStore) path(version string) string { return filepath.Join(s.dir, version) + ".gz" }
+
+// Get reads version's dump.
+func (s *DirStore) Get(_ context.Context, version string) ([]byte, error) {
+	return os.ReadFile(s.path(version))
+}
+
+// Put writes version's dump.
+func (s *DirStore) Put(_ context.Context, version string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("edmain/make dump dir: %v", err)
+	}
+	writeReadme(s.dir)
+	if err := writeFileAtomic(s.path(version), data); err != nil {
+		return fmt.Errorf("edmain/write dump: %v", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data into fname through a temp file and a rename so that the readers never see a partial file.
+// The temp file is a hidden file in the same directory.
+func writeFileAtomic(fname string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fname), ".tmp-"+filepath.Base(fname)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// writeReadme writes a README into the dump directory explaining its purpose if it doesn't have one yet.
+func writeReadme(dir string) {
+	readme := filepath.Join(dir, "README")
+	if _, err := os.Stat(readme); err != nil {
+		content := `This is the effdump directory for %s.
+More info about effdump at https://github.com/ypsu/effdump.
+These files are used during development to inspect diffs.
+They can be deleted because they can be easily regenerated.
+effdump relies on a tmp reaper daemon to keep the number of files limited.
+You have that set up, right?
+Otherwise just run this regularly:
+
+	go run %q clear
+
+Or keep only the recently saved dumps via something like this:
+
+	go run %q -keep=20 gc
+`
+		bi, _ := debug.ReadBuildInfo()
+		contentBytes := fmt.Appendf(nil, content, bi.Path, bi.Path, bi.Path)
+		os.WriteFile(readme, contentBytes, 0644) // ignore error, don't care for this readme
+	}
+}
+
+// List returns the sorted list of versions in the directory.
+func (s *DirStore) List(context.Context) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.gz"))
+	if err != nil {
+		return nil, fmt.Errorf("edmain/glob dumps: %v", err)
+	}
+	versions := make([]string, 0, len(files))
+	for _, f := range files {
+		versions = append(versions, strings.TrimSuffix(filepath.Base(f), ".gz"))
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// Delete deletes version's dump.
+func (s *DirStore) Delete(_ context.Context, version string) error {
+	return os.Remove(s.path(version))
+}
+
+// ModTime returns the modification time of version's file.
+func (s *DirStore) ModTime(_ context.Context, version string) (time.Time, error) {
+	fi, err := os.Stat(s.path(version))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// PeekHeader reads only the header of version's dump.
+func (s *DirStore) PeekHeader(_ context.Context, version string) (Header, error) {
+	f, err := os.Open(s.path(version))
+	if err != nil {
+		return Header{}, err
+	}
+	defer f.Close()
+	return PeekHeader(f)
+}
+
+// localStore returns the store without its remote if it has one.
+func localStore(store Store) Store {
+	if s, ok := store.(*remoteStore); ok {
+		return s.local
+	}
+	return store
+}
+
+// localDir returns the local directory of the store or empty string if the store has none.
+func localDir(store Store) string {
+	switch s := store.(type) {
+	case *DirStore:
+		return s.dir
+	case *CASStore:
+		return s.dir
+	case *remoteStore:
+		return localDir(s.local)
+	}
+	return ""
+}
+
+// lock takes the advisory lock on the store's local directory for the subcommands modifying the saved dumps.
+// Concurrent saves, clears, and gcs wait for each other this way.
+// Returns a no-op unlock for the stores without a local directory: those handle the concurrency on their own.
+func (p *Params) lock() (unlock func(), err error) {
+	dir := localDir(p.Store)
+	if dir == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("edmain/make dump dir: %v", err)
+	}
+	return lockDir(dir)
+}
+
+// where describes the location of version's dump for the user.
+func (p *Params) where(version string) string { return describe(p.Store, version) }
+
+func describe(store Store, version string) string {
+	switch s := store.(type) {
+	case *DirStore:
+		return s.path(version)
+	case *CASStore:
+		return s.path(version)
+	case *remoteStore:
+		return fmt.Sprintf("%s (remote %s%s.gz)", describe(s.local, version), s.remote.url, version)
+	}
+	return fmt.Sprintf("%s in %v", version, store)
+}
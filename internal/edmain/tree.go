@@ -0,0 +1,234 @@
+package edmain
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/keyvalue"
+)
+
+// The escaping scheme of the keys in the materialized directory trees:
+//
+//   - The keys are split on "/" into path segments.
+//   - The bytes of the segments outside [A-Za-z0-9._+=,@-] are percent-encoded as %XX with uppercase hex digits.
+//     E.g. "with space" is "with%20space" and "100%" is "100%25".
+//   - The empty, ".", and ".." segments are encoded as "%", "%2E", and "%2E%2E" respectively.
+//   - If other keys are below a key, e.g. both "a" and "a/b" are keys, then the key's value is in the "%%" file of its directory, e.g. "a/%%".
+//
+// ingest accepts only this canonical encoding so each key has exactly one path and vice versa.
+
+// treeIndexFile holds the value of a key that is a directory too.
+const treeIndexFile = "%%"
+
+func isSafePathByte(ch byte) bool {
+	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || '0' <= ch && ch <= '9' || strings.IndexByte("._+=,@-", ch) >= 0
+}
+
+// escapeSegment escapes a key's path segment into a file name.
+func escapeSegment(seg string) string {
+	switch seg {
+	case "":
+		return "%"
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	w := &strings.Builder{}
+	for i := 0; i < len(seg); i++ {
+		if isSafePathByte(seg[i]) {
+			w.WriteByte(seg[i])
+		} else {
+			fmt.Fprintf(w, "%%%02X", seg[i])
+		}
+	}
+	return w.String()
+}
+
+// unescapeSegment is the inverse of escapeSegment.
+// Returns an error for the file names that escapeSegment never generates.
+func unescapeSegment(name string) (string, error) {
+	if name == "%" {
+		return "", nil
+	}
+	w := &strings.Builder{}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			w.WriteByte(name[i])
+			continue
+		}
+		var ch byte
+		if i+2 >= len(name) || !isUpperHex(name[i+1]) || !isUpperHex(name[i+2]) {
+			return "", fmt.Errorf("edmain/unescape %q: %% must be followed by two uppercase hex digits", name)
+		}
+		fmt.Sscanf(name[i+1:i+3], "%02X", &ch)
+		w.WriteByte(ch)
+		i += 2
+	}
+	seg := w.String()
+	if escapeSegment(seg) != name {
+		return "", fmt.Errorf("edmain/unescape %q: not in the canonical escaped form %q", name, escapeSegment(seg))
+	}
+	return seg, nil
+}
+
+func isUpperHex(ch byte) bool { return '0' <= ch && ch <= '9' || 'A' <= ch && ch <= 'F' }
+
+// keyPath returns the slash separated relative path of a key in the materialized tree.
+// dirs contains the escaped paths of the directories the other keys need.
+func keyPath(key string, dirs map[string]bool) string {
+	segs := strings.Split(key, "/")
+	for i, seg := range segs {
+		segs[i] = escapeSegment(seg)
+	}
+	path := strings.Join(segs, "/")
+	if dirs[path] {
+		return path + "/" + treeIndexFile
+	}
+	return path
+}
+
+// pathKey is the inverse of keyPath.
+// isIndex reports whether path is a treeIndexFile.
+// The caller must check that the other keys are below such a key, otherwise "a/%%" and "a" would be the same key.
+func pathKey(path string) (key string, isIndex bool, err error) {
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if seg != treeIndexFile {
+			continue
+		}
+		if i == 0 || i != len(segs)-1 {
+			return "", false, fmt.Errorf("edmain/check %s: %s can only be the last segment in a directory", path, treeIndexFile)
+		}
+		segs, isIndex = segs[:i], true
+	}
+	for i, seg := range segs {
+		s, err := unescapeSegment(seg)
+		if err != nil {
+			return "", false, err
+		}
+		segs[i] = s
+	}
+	return strings.Join(segs, "/"), isIndex, nil
+}
+
+// cmdMaterialize writes each effect into dir as a file at its key's path.
+// dir must be empty or missing.
+func (p *Params) cmdMaterialize(dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("edmain/check dir: %s is not empty", dir)
+	}
+	dirs := map[string]bool{}
+	for _, e := range p.Effects {
+		segs := strings.Split(e.K, "/")
+		for i := range segs {
+			segs[i] = escapeSegment(segs[i])
+		}
+		for i := 1; i < len(segs); i++ {
+			dirs[strings.Join(segs[:i], "/")] = true
+		}
+	}
+	for _, e := range p.Effects {
+		fname := filepath.Join(dir, filepath.FromSlash(keyPath(e.K, dirs)))
+		if err := os.MkdirAll(filepath.Dir(fname), 0o755); err != nil {
+			return fmt.Errorf("edmain/make dir for %q: %v", e.K, err)
+		}
+		// O_EXCL catches the collisions on the case-insensitive filesystems.
+		f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return fmt.Errorf("edmain/create file for %q: %v", e.K, err)
+		}
+		_, err = f.WriteString(e.V)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("edmain/write file for %q: %v", e.K, err)
+		}
+	}
+	fmt.Fprintf(p.Stdout, "Materialized %d effects into %s.\n", len(p.Effects), dir)
+	return nil
+}
+
+// readTree reads the files of a materialized tree as key-value pairs.
+// It rejects the trees over the limits, with non-regular files, or with non-canonical file names.
+func readTree(dir string, lim Limits) ([]keyvalue.KV, error) {
+	var kvs []keyvalue.KV
+	total := 0
+	indexes, parents := map[string]string{}, map[string]bool{}
+	err := filepath.WalkDir(dir, func(fname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("edmain/check %s: not a regular file", rel)
+		}
+		key, isIndex, err := pathKey(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		if isIndex {
+			indexes[key] = filepath.ToSlash(rel)
+		}
+		for i := strings.LastIndexByte(key, '/'); i >= 0; i = strings.LastIndexByte(key[:i], '/') {
+			parents[key[:i]] = true
+		}
+		if len(kvs) >= lim.MaxEntries {
+			return fmt.Errorf("edmain/check limits: tree has more than %d files", lim.MaxEntries)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if total += int(info.Size()); total > lim.MaxBytes {
+			return fmt.Errorf("edmain/check limits: tree is over %d bytes", lim.MaxBytes)
+		}
+		v, err := os.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, keyvalue.KV{key, string(v)})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("edmain/read tree: %v", err)
+	}
+	for key, path := range indexes {
+		if !parents[key] {
+			return nil, fmt.Errorf("edmain/check %s: no other keys are below %q, the key's value must be in the file %s", path, key, keyPath(key, nil))
+		}
+	}
+	slices.SortFunc(kvs, func(a, b keyvalue.KV) int { return cmp.Compare(a.K, b.K) })
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i].K == kvs[i-1].K {
+			return nil, fmt.Errorf("edmain/unique check: key %q duplicated", kvs[i].K)
+		}
+	}
+	return kvs, nil
+}
+
+// cmdIngest validates a materialized tree and saves it as a version.
+func (p *Params) cmdIngest(ctx context.Context, dir string) error {
+	version, err := p.importVersion(dir)
+	if err != nil {
+		return err
+	}
+	kvs, err := readTree(dir, p.Limits)
+	if err != nil {
+		return err
+	}
+	return p.saveImported(ctx, version, dir, kvs)
+}
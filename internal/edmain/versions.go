@@ -0,0 +1,94 @@
+package edmain
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// versionInfo describes a saved version for the versions subcommand.
+type versionInfo struct {
+	Version string `json:"version"`
+	Saved   string `json:"saved,omitempty"`
+	Entries int    `json:"entries"`
+	Size    int    `json:"size"`
+	Hash    string `json:"hash,omitempty"` // the digest, the header's hash in hex for the dumps saved without one
+	Subject string `json:"subject,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	savetime time.Time
+}
+
+// cmdVersions lists the saved versions along with their metadata, newest first.
+func (p *Params) cmdVersions(ctx context.Context) error {
+	versions, err := p.Store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("edmain/versions list: %v", err)
+	}
+	mt, _ := p.Store.(modTimer)
+	infos := make([]versionInfo, 0, len(versions))
+	for _, v := range versions {
+		info := versionInfo{Version: v}
+		if mt != nil {
+			if t, err := mt.ModTime(ctx, v); err == nil {
+				info.savetime, info.Saved = t, t.UTC().Format(time.RFC3339)
+			}
+		}
+		if p.VSDescribe != nil {
+			info.Subject, _ = p.VSDescribe(ctx, v) // not all versions are commits
+		}
+		data, err := p.Store.Get(ctx, v)
+		if err != nil {
+			info.Error = err.Error()
+		} else if hdr, err := PeekHeader(bytes.NewReader(data)); err != nil {
+			info.Error = err.Error()
+		} else {
+			info.Entries, info.Size = hdr.Entries, hdr.Size
+			if m := hdr.Manifest; m != nil && m.Parent != "" {
+				info.Entries, info.Size = m.Entries, m.Size // the header has the delta's counts
+			}
+			if hdr.hasDigest() {
+				info.Hash = hdr.Manifest.Hash
+			} else {
+				info.Hash = fmt.Sprintf("%016x", hdr.Hash) // the bare header hash like before the digests
+			}
+		}
+		infos = append(infos, info)
+	}
+	slices.SortStableFunc(infos, func(a, b versionInfo) int { return b.savetime.Compare(a.savetime) })
+
+	if p.JSON {
+		enc := json.NewEncoder(p.Stdout)
+		for _, info := range infos {
+			if err := enc.Encode(info); err != nil {
+				return fmt.Errorf("edmain/versions encode: %v", err)
+			}
+		}
+		return nil
+	}
+	if len(infos) == 0 {
+		fmt.Fprintf(p.Stdout, "NOTE: No saved versions in %v.\n", p.Store)
+		return nil
+	}
+	tw := tabwriter.NewWriter(p.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSAVED\tENTRIES\tSIZE\tHASH\tSUBJECT")
+	for _, info := range infos {
+		if info.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\tERROR: %s\n", info.Version, cond(info.Saved == "", "-", info.Saved), info.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", info.Version, cond(info.Saved == "", "-", info.Saved), info.Entries, info.Size, info.Hash, info.Subject)
+	}
+	return tw.Flush()
+}
+
+func cond[T any](c bool, ontrue, onfalse T) T {
+	if c {
+		return ontrue
+	}
+	return onfalse
+}
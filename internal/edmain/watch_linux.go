@@ -11,7 +11,6 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -79,7 +78,7 @@ func fittedPrint(s []byte) {
 // The resulting subprocess must be collected via the returned kill command.
 // It first compiles the command into edbin and then runs it with the specified args.
 func startcmd(ctx context.Context, gobin, edpkg, edbin, tags string, argv []string, env []string, sigch <-chan os.Signal) (output []byte, kill func()) {
-	compilerOutput, err := exec.CommandContext(ctx, gobin, "build", "-tags="+tags, "-o="+edbin, edpkg).CombinedOutput()
+	compilerOutput, err := gobuild(ctx, gobin, "", edpkg, edbin, tags)
 	if err != nil {
 		return compilerOutput, func() {}
 	}
@@ -207,18 +206,9 @@ func reportchanges(changed chan<- bool) {
 
 // watch runs the current command repeatedly after each filesystem change (with -watch flag removed).
 func (p *Params) watch(ctx context.Context) error {
-	bi, ok := debug.ReadBuildInfo()
-	if !ok {
-		return fmt.Errorf("edmain/watch: couldn't fetch buildinfo")
-	}
-	if bi.Path == "command-line-arguments" {
-		return fmt.Errorf("edmain/check target: go run target must be of form yourmodule/yourpackage, specifying .go files directly is not supported")
-	}
-	var tags string
-	for _, setting := range bi.Settings {
-		if setting.Key == "-tags" {
-			tags = setting.Value
-		}
+	edpkg, tags, err := buildtarget()
+	if err != nil {
+		return err
 	}
 
 	gobin, err := exec.LookPath("go")
@@ -242,7 +232,7 @@ func (p *Params) watch(ctx context.Context) error {
 	}
 	for ctx.Err() == nil {
 		fmt.Fprintf(os.Stderr, "compiling... ")
-		output, kill := startcmd(ctx, gobin, bi.Path, edbin, tags, argv, env, sigch)
+		output, kill := startcmd(ctx, gobin, edpkg, edbin, tags, argv, env, sigch)
 		fittedPrint(output)
 		select {
 		case <-fsch:
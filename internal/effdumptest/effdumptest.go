@@ -2,17 +2,28 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"embed"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ypsu/effdump"
@@ -21,6 +32,7 @@ import (
 	"github.com/ypsu/effdump/internal/edmain"
 	"github.com/ypsu/effdump/internal/edtextar"
 	"github.com/ypsu/effdump/internal/fmtdiff"
+	"github.com/ypsu/effdump/internal/git"
 	"github.com/ypsu/effdump/internal/keyvalue"
 )
 
@@ -52,6 +64,71 @@ func testdata(fn string) string {
 	return string(buf)
 }
 
+// wdiff marks the spans of line with on and off.
+func wdiff(line string, spans []andiff.Span, on, off string) string {
+	w, pos := &strings.Builder{}, 0
+	for _, s := range spans {
+		w.WriteString(line[pos:s.Start] + on + line[s.Start:s.End] + off)
+		pos = s.End
+	}
+	w.WriteString(line[pos:])
+	return w.String()
+}
+
+// memstore is an in-memory edmain.Store.
+type memstore map[string][]byte
+
+func (memstore) String() string { return "memstore" }
+
+func (s memstore) Get(_ context.Context, version string) ([]byte, error) {
+	data, ok := s[version]
+	if !ok {
+		return nil, fmt.Errorf("effdumptest/memstore get %s: %w", version, fs.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (s memstore) Put(_ context.Context, version string, data []byte) error {
+	s[version] = data
+	return nil
+}
+
+func (s memstore) List(context.Context) ([]string, error) {
+	versions := make([]string, 0, len(s))
+	for v := range s {
+		versions = append(versions, v)
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+func (s memstore) Delete(_ context.Context, version string) error {
+	if _, ok := s[version]; !ok {
+		return fmt.Errorf("effdumptest/memstore delete %s: %w", version, fs.ErrNotExist)
+	}
+	delete(s, version)
+	return nil
+}
+
+// splitMembers splits a compressed dump into its gzip members.
+func splitMembers(data []byte) ([][]byte, error) {
+	var members [][]byte
+	for len(data) > 0 {
+		src := bytes.NewReader(data)
+		r, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/split members: %v", err)
+		}
+		r.Multistream(false)
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, fmt.Errorf("effdumptest/split members: %v", err)
+		}
+		n := len(data) - src.Len()
+		members, data = append(members, data[:n]), data[n:]
+	}
+	return members, nil
+}
+
 func mkdump() (*effdump.Dump, error) {
 	debuglog := &strings.Builder{}
 	edbg.Printf = func(format string, v ...any) { fmt.Fprintf(debuglog, format, v...) }
@@ -119,25 +196,59 @@ func mkdump() (*effdump.Dump, error) {
 		for _, op := range diff.Ops {
 			fmt.Fprintf(w, "%+v\n", op)
 		}
+		for _, m := range diff.Moves {
+			fmt.Fprintf(w, "%+v\n", m)
+		}
 		kvs = append(kvs, keyvalue.KV{"diff", w.String()})
 		if debuglog.Len() > 0 {
 			kvs = append(kvs, keyvalue.KV{"debuglog", debuglog.String()})
 			debuglog.Reset()
 		}
 		kvs = append(kvs, keyvalue.KV{"unified", fmtdiff.Unified(diff, 3, false)})
+		inline, xi, yi := &strings.Builder{}, 0, 0
+		for _, op := range diff.Ops {
+			for k := 0; k < min(op.Del, op.Add); k++ {
+				lt, rt := andiff.Inline(diff.LT[xi+k], diff.RT[yi+k])
+				if lt == nil && rt == nil {
+					continue
+				}
+				fmt.Fprintf(inline, "-%s\n+%s\n", wdiff(diff.LT[xi+k], lt, "[-", "-]"), wdiff(diff.RT[yi+k], rt, "{+", "+}"))
+			}
+			xi, yi = xi+op.Del+op.Keep, yi+op.Add+op.Keep
+		}
+		if inline.Len() > 0 {
+			kvs = append(kvs, keyvalue.KV{"inline", inline.String()})
+		}
+		for _, algo := range andiff.Algorithms[1:] {
+			if d := andiff.ComputeAlgo(algo, lt.String(), rt.String(), rmregexp); !slices.Equal(d.Ops, diff.Ops) {
+				kvs = append(kvs, keyvalue.KV{algo, fmtdiff.Unified(d, 3, false)})
+			}
+		}
 		d.Add("diffs/"+name+".txt", edtextar.Format(kvs, '-'))
 		buckets := []fmtdiff.Bucket{{Entries: []fmtdiff.Entry{{Name: "html", Diff: diff}}}}
-		d.Add("diffs/"+name+".html", fmtdiff.HTMLBuckets(buckets, nil, 3))
+		d.Add("diffs/"+name+".html", fmtdiff.HTMLBuckets(buckets, nil, nil, 3))
 	}
 
 	// Set up common helpers for the CLI tests.
 	group, key, desc, w, log := "", "", "", &strings.Builder{}, &strings.Builder{}
+	remoteURL := "" // replaced with a stable URL in the outputs
 	fetchVersion, fetchDirty, fetchErr := "numsbase", false, error(nil)
+	goversion := "go1.99.0"
 	baseParams := edmain.Params{
 		Name:    "testdump",
 		Effects: edtextar.Parse(nil, testdata("numsbase.textar")),
 		Env:     []string{"EFFDUMP_DIR=" + tmpdir},
 		Stdout:  w,
+		Now:     func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+
+		BuildInfo: func() (*debug.BuildInfo, bool) {
+			return &debug.BuildInfo{
+				GoVersion: goversion,
+				Path:      "example.com/testdump",
+				Main:      debug.Module{Path: "example.com", Version: "(devel)"},
+				Settings:  []debug.BuildSetting{{Key: "-tags", Value: "testtag"}},
+			}, true
+		},
 
 		VSHasChanges: func(context.Context) (bool, error) {
 			edbg.Printf("VSHasChanges() -> (%t, %v)\n", fetchDirty, fetchErr)
@@ -148,11 +259,18 @@ func mkdump() (*effdump.Dump, error) {
 			edbg.Printf("VSResolve(%q) -> (%q, %v)\n", ref, fetchVersion, fetchErr)
 			return fetchVersion, fetchErr
 		},
+
+		VSDescribe: func(_ context.Context, version string) (string, error) {
+			if !strings.HasPrefix(version, "v") {
+				return "", fmt.Errorf("unknown version")
+			}
+			return "subject of " + version, nil
+		},
 	}
 	p := baseParams
 	run := func(args ...string) {
 		kvs := make([]keyvalue.KV, 1, 4)
-		kvs[0] = keyvalue.KV{"desc", fmt.Sprintf("%s\n\nargs: testdump %q", desc, args)}
+		kvs[0] = keyvalue.KV{"desc", strings.ReplaceAll(fmt.Sprintf("%s\n\nargs: testdump %q", desc, args), tmpdir, "/tmpdir")}
 		fs := flag.NewFlagSet("effdumptest", flag.ContinueOnError)
 		p.RegisterFlags(fs)
 		p.Color = "no"
@@ -164,11 +282,18 @@ func mkdump() (*effdump.Dump, error) {
 		err := p.Run(ctx)
 		if w.Len() > 0 {
 			stdout := strings.ReplaceAll(w.String(), tmpdir, "/tmpdir")
+			if remoteURL != "" {
+				stdout = strings.ReplaceAll(stdout, remoteURL, "http://remote")
+			}
 			kvs = append(kvs, keyvalue.KV{"stdout", stdout})
 			w.Reset()
 		}
 		if err != nil {
-			kvs = append(kvs, keyvalue.KV{"error", err.Error()})
+			msg := strings.ReplaceAll(err.Error(), tmpdir, "/tmpdir")
+			if remoteURL != "" {
+				msg = strings.ReplaceAll(msg, remoteURL, "http://remote")
+			}
+			kvs = append(kvs, keyvalue.KV{"error", msg})
 		}
 		if log.Len() > 0 {
 			kvs = append(kvs, keyvalue.KV{"log", log.String()})
@@ -188,7 +313,7 @@ func mkdump() (*effdump.Dump, error) {
 
 	// The baseline for the following tests will be numsbase.
 	numsbase := edtextar.Parse(nil, testdata("numsbase.textar"))
-	gz, err := edmain.Compress(numsbase, '=', edmain.Hash(numsbase))
+	gz, err := edmain.Compress(numsbase, '=', edmain.Hash(numsbase), nil, edmain.DefaultLimits)
 	if err != nil {
 		return nil, fmt.Errorf("effdumptest/compress numsbase: %v", err)
 	}
@@ -281,7 +406,7 @@ func mkdump() (*effdump.Dump, error) {
 	{
 		setdesc("bad-baseline", "Diffing against a baseline that can't be parsed.")
 		badkvs := append(slices.Clone(numsbase), keyvalue.KV{"aaa", "somevalue"})
-		gz, err := edmain.Compress(badkvs, '=', edmain.Hash(badkvs))
+		gz, err := edmain.Compress(badkvs, '=', edmain.Hash(badkvs), nil, edmain.DefaultLimits)
 		if err != nil {
 			return nil, fmt.Errorf("effdumptest/compress badkvs: %v", err)
 		}
@@ -302,7 +427,7 @@ func mkdump() (*effdump.Dump, error) {
 		for i := 0; i < n; i++ {
 			seqkvs = append(seqkvs, keyvalue.KV{strconv.Itoa(i + 10), content})
 		}
-		gz, err := edmain.Compress(seqkvs, '=', edmain.Hash(seqkvs))
+		gz, err := edmain.Compress(seqkvs, '=', edmain.Hash(seqkvs), nil, edmain.DefaultLimits)
 		if err != nil {
 			return nil, fmt.Errorf("effdumptest/compress seqkvs: %v", err)
 		}
@@ -316,6 +441,185 @@ func mkdump() (*effdump.Dump, error) {
 		run("diff")
 	}
 
+	group = "algo"
+	{
+		algokvs := []keyvalue.KV{
+			{"list", "a\nb\nc\na\nb\nb\na\n"},
+			{"morelist", "a\nb\nc\na\nb\nb\na\n"},
+		}
+		gz, err := edmain.Compress(algokvs, '=', edmain.Hash(algokvs), nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress algokvs: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpdir, "algokvs.gz"), gz, 0o644); err != nil {
+			return nil, fmt.Errorf("effdumptest/write algokvs.gz: %v", err)
+		}
+		algokvs = []keyvalue.KV{
+			{"list", "c\nb\na\nb\na\nc\n"},
+			{"morelist", "c\nb\na\nb\na\nc\n"},
+		}
+		for _, algo := range append([]string{""}, andiff.Algorithms...) {
+			name := algo
+			if name == "" {
+				name = "default"
+			}
+			setdesc(name, "Diff with -algo="+algo+". The two list diffs should be in the same bucket.")
+			fetchVersion, p.Effects = "algokvs", slices.Clone(algokvs)
+			run("-algo="+algo, "diff")
+		}
+		setdesc("bad-algo", "An unknown -algo should be an error.")
+		run("-algo=bogus", "diff")
+		setdesc("per-key", "The myers algorithm for the list only. Now the two list diffs are in different buckets.")
+		fetchVersion, p.Effects = "algokvs", slices.Clone(algokvs)
+		p.DiffAlgos = []edmain.DiffAlgo{{edmain.MakeRE("list"), andiff.Myers}}
+		run("diff")
+		setdesc("per-key-later-wins", "The later per-key algorithm wins: patience for the lists.")
+		fetchVersion, p.Effects = "algokvs", slices.Clone(algokvs)
+		p.DiffAlgos = []edmain.DiffAlgo{{edmain.MakeRE(), andiff.Myers}, {edmain.MakeRE("*list"), andiff.Patience}}
+		run("diff", "*list")
+		setdesc("flag-overrides-per-key", "The -algo flag overrides the per-key algorithms: the list is diffed with anchored too.")
+		fetchVersion, p.Effects = "algokvs", slices.Clone(algokvs)
+		p.DiffAlgos = []edmain.DiffAlgo{{edmain.MakeRE("list"), andiff.Myers}}
+		run("-algo=anchored", "diff", "*list")
+		setdesc("bad-per-key", "An unknown per-key algorithm should be an error.")
+		p.DiffAlgos = []edmain.DiffAlgo{{edmain.MakeRE("list"), "bogus"}}
+		run("diff")
+	}
+
+	group = "moves"
+	{
+		cities := func(names ...string) string {
+			w := &strings.Builder{}
+			for _, name := range names {
+				fmt.Fprintf(w, "[%s]\ntimezone = CET\npopulation = %dK\n\n", name, len(name)*100)
+			}
+			return w.String()
+		}
+		movekvs := []keyvalue.KV{
+			{"europe", cities("berlin", "madrid", "paris", "rome")},
+			{"south", cities("athens", "rome", "sofia", "madrid")},
+			{"unmoved", cities("berlin", "paris")},
+		}
+		gz, err := edmain.Compress(movekvs, '=', edmain.Hash(movekvs), nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress movekvs: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpdir, "movekvs.gz"), gz, 0o644); err != nil {
+			return nil, fmt.Errorf("effdumptest/write movekvs.gz: %v", err)
+		}
+		movekvs = []keyvalue.KV{
+			{"europe", cities("berlin", "paris", "rome", "madrid")},
+			{"south", cities("madrid", "athens", "rome", "sofia")},
+			{"unmoved", cities("berlin", "vienna")},
+		}
+		setdesc("diff", "madrid moved down in europe and up in south: both are pure reorders of the same block so they are in the same bucket.")
+		fetchVersion, p.Effects = "movekvs", slices.Clone(movekvs)
+		run("diff")
+		setdesc("htmldiff", "The moved blocks link to each other in the HTML diff.")
+		fetchVersion, p.Effects = "movekvs", slices.Clone(movekvs)
+		run("htmldiff")
+		setdesc("color", "The moved lines have their own color.")
+		fetchVersion, p.Effects = "movekvs", slices.Clone(movekvs)
+		run("-color=yes", "diff", "europe")
+	}
+
+	group = "jsondiff"
+	{
+		type deployment struct {
+			City  string
+			MemGB int
+			Tags  []string `json:",omitempty"`
+		}
+		type config struct {
+			Name        string
+			Deployments []deployment
+			Limits      map[string]float64
+		}
+		base := config{
+			Name:        "frontend",
+			Deployments: []deployment{{"berlin", 2, nil}, {"london", 4, []string{"eu"}}, {"paris", 4, nil}, {"rome", 4, nil}},
+			Limits:      map[string]float64{"cpu": 1.5, "qps <= x": 100},
+		}
+		changed := base
+		changed.Deployments = slices.Clone(base.Deployments)
+		changed.Deployments[3].MemGB = 8
+		changed.Deployments = slices.Insert(changed.Deployments, 1, deployment{"dublin", 2, nil})
+		changed.Limits = map[string]float64{"cpu": 2, "disk": 10}
+		jsonkvs := []keyvalue.KV{
+			{"config", edmain.Stringify(base)},
+			{"keyorder", "{\"a\": 1, \"b\": [1, 2]}\n"},
+			{"notjson", "hello\n"},
+			{"toplevel", "[1, 2, 3]\n"},
+		}
+		gz, err := edmain.Compress(jsonkvs, '=', edmain.Hash(jsonkvs), nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress jsonkvs: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpdir, "jsonkvs.gz"), gz, 0o644); err != nil {
+			return nil, fmt.Errorf("effdumptest/write jsonkvs.gz: %v", err)
+		}
+		jsonkvs = []keyvalue.KV{
+			{"config", edmain.Stringify(changed)},
+			{"keyorder", "{\"b\": [1, 2], \"a\": 1}\n"},
+			{"notjson", "world\n"},
+			{"toplevel", "{\"a\": [1, 2, 3]}\n"},
+		}
+		setdesc("diff", "The config diff lists the changes by JSON path: an inserted deployment, a changed and a removed field, and a changed array element.")
+		fetchVersion, p.Effects = "jsonkvs", slices.Clone(jsonkvs)
+		run("-jsondiff", "diff")
+		setdesc("no-flag", "Without -jsondiff there is no structural diff.")
+		fetchVersion, p.Effects = "jsonkvs", slices.Clone(jsonkvs)
+		run("diff", "config")
+		setdesc("htmldiff", "The structural diff is a separate table in the HTML diff.")
+		fetchVersion, p.Effects = "jsonkvs", slices.Clone(jsonkvs)
+		run("-jsondiff", "htmldiff", "config", "keyorder")
+	}
+
+	group = "similarity"
+	{
+		service := func(name, memory string) string {
+			return fmt.Sprintf("[%s]\nmemory = %s\nreplicas = 3\n", name, memory)
+		}
+		bump := func(change int, reason string) string {
+			return fmt.Sprintf("8 GiB  # bumped in change %d due to %s OOMs", change, reason)
+		}
+		simkvs := []keyvalue.KV{
+			{"api", service("api", "4 GiB")},
+			{"api-staging", service("api-staging", "4 GiB")},
+			{"db", service("db", "4 GiB")},
+			{"web", service("web", "4 GiB")},
+			{"worker", service("worker", "4 GiB")},
+		}
+		gz, err := edmain.Compress(simkvs, '=', edmain.Hash(simkvs), nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress simkvs: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpdir, "simkvs.gz"), gz, 0o644); err != nil {
+			return nil, fmt.Errorf("effdumptest/write simkvs.gz: %v", err)
+		}
+		simkvs = []keyvalue.KV{
+			{"api", service("api", bump(1234, "api"))},
+			{"api-staging", service("api-staging", bump(1234, "api"))},
+			{"db", service("db", "4 GiB") + "readonly = true\n"},
+			{"web", service("web", bump(1234, "web"))},
+			{"worker", service("worker", bump(1240, "worker"))},
+		}
+		setdesc("diff", "The web bump differs from the api bump only in the service name so it's merged into the api bucket but its diff is still shown.")
+		fetchVersion, p.Effects = "simkvs", slices.Clone(simkvs)
+		run("-similarity=0.6", "diff")
+		setdesc("no-flag", "Without -similarity each distinct diff is its own bucket.")
+		fetchVersion, p.Effects = "simkvs", slices.Clone(simkvs)
+		run("diffkeys")
+		setdesc("diffkeys", "The lower threshold merges the worker bump too, diffkeys lists the merged entries with their similarity.")
+		fetchVersion, p.Effects = "simkvs", slices.Clone(simkvs)
+		run("-similarity=0.5", "diffkeys")
+		setdesc("htmldiff", "The HTML diff lists the merged entries in the representative's bucket.")
+		fetchVersion, p.Effects = "simkvs", slices.Clone(simkvs)
+		run("-similarity=0.5", "htmldiff")
+		setdesc("bad-value", "The similarity must be between 0 and 1.")
+		run("-similarity=1.5", "diff")
+	}
+
 	group = "cmd-diffkeys"
 	setdesc("base-no-args", "Diffing base against base without args should have no diff.")
 	run("diffkeys")
@@ -350,10 +654,61 @@ func mkdump() (*effdump.Dump, error) {
 	run("hash")
 	setdesc("some-args", "Subcommand hash doesn't take args")
 	run("hash", "even")
+	setdesc("sha256", "Print the SHA-256 hash of the nums effdump.")
+	run("-hash=sha256", "hash")
+	setdesc("legacy", "Print the bare hex hash that hash printed before the versioned hashes.")
+	run("-hash=legacy", "hash")
+	setdesc("legacy-save", "The legacy hash is only for the hash subcommand, the saved dumps don't record it.")
+	run("-hash=legacy", "save")
+	setdesc("unknown-algo", "Unknown hash algorithms are rejected.")
+	run("-hash=md5", "hash")
+	setdesc("ambiguous", "The hash includes the key and value boundaries.")
+	p.Effects = []keyvalue.KV{{"ab", "c"}}
+	run("hash")
+	setdesc("ambiguous-other", "The hash includes the key and value boundaries.")
+	p.Effects = []keyvalue.KV{{"a", "bc"}}
+	run("hash")
+	hd := effdump.New("hashed")
+	for _, kv := range numsbase {
+		hd.Add(kv.K, kv.V)
+	}
+	digest, err := hd.Digest("fnv2")
+	d.Add(group+"/dump-hash", fmt.Sprintf("Hash: %016x\nDigest: %s %v\n", hd.Hash(), digest, err))
+
+	group = "cmd-hashes"
+	hashesdir := filepath.Join(tmpdir, "hashes")
+	os.MkdirAll(hashesdir, 0o755)
+	writeHashes := func(fname string, kvs []keyvalue.KV) {
+		w := &strings.Builder{}
+		for _, kv := range kvs {
+			digest, _ := edmain.Digest([]keyvalue.KV{kv}, "fnv2")
+			fmt.Fprintf(w, "%s %s\n", digest, strconv.Quote(kv.K))
+		}
+		os.WriteFile(filepath.Join(hashesdir, fname), []byte(w.String()), 0o644)
+	}
+	writeHashes("nums", numsbase)
+	os.WriteFile(filepath.Join(hashesdir, "malformed"), []byte("fnv2:0123 even\nnohash\n"), 0o644)
+	setdesc("print", "Print the hash of each effect.")
+	run("hashes")
+	setdesc("print-globs", "Print the SHA-256 hash of the matching effects.")
+	run("-hash=sha256", "hashes", "even*")
+	setdesc("print-quoted", "The keys with newlines and leading quotes are quoted.")
+	p.Effects = []keyvalue.KV{{"\"quoted", "1\n"}, {"multi\nline", "2\n"}, {"with space", "3\n"}}
+	run("hashes")
+	setdesc("check", "The hashes match the file.")
+	run("-check="+filepath.Join(hashesdir, "nums"), "hashes")
+	setdesc("check-changed", "List the added, removed, and changed keys.")
+	p.Effects = edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("-check="+filepath.Join(hashesdir, "nums"), "hashes")
+	setdesc("check-globs", "Only compare the matching keys.")
+	p.Effects = edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("-check="+filepath.Join(hashesdir, "nums"), "hashes", "prime*")
+	setdesc("check-missing", "A missing hashes file is an error.")
+	run("-check="+filepath.Join(hashesdir, "nosuch"), "hashes")
+	setdesc("check-malformed", "A malformed hashes file is an error.")
+	run("-check="+filepath.Join(hashesdir, "malformed"), "hashes")
 
 	group = "cmd-save"
-	setdesc("with-args", "Save cannot take args.")
-	run("save", "somearg")
 	setdesc("unclean-save-not-forced", "Save in unclean client needs -force.")
 	fetchVersion, fetchDirty = "saved", true
 	run("save")
@@ -371,6 +726,161 @@ func mkdump() (*effdump.Dump, error) {
 	fetchVersion, fetchDirty = "saved", false
 	run()
 
+	group = "shard"
+	shards, shardeffects := memstore{}, make([][]keyvalue.KV, 3)
+	for _, kv := range numsbase {
+		i := edmain.ShardOf(kv.K, 3)
+		shardeffects[i] = append(shardeffects[i], kv)
+	}
+	inshard := &strings.Builder{}
+	for i := 0; i < 3; i++ {
+		sd, sfs := effdump.New("sharded"), flag.NewFlagSet("sharded", flag.ContinueOnError)
+		sd.RegisterFlags(sfs)
+		sfs.Parse([]string{fmt.Sprintf("-shard=%d/3", i)})
+		index, count, err := sd.Shard()
+		fmt.Fprintf(inshard, "shard %d/%d (%v):", index, count, err)
+		for _, kv := range numsbase {
+			if sd.InShard(kv.K) {
+				fmt.Fprintf(inshard, " %s", kv.K)
+			}
+		}
+		fmt.Fprintln(inshard)
+	}
+	{
+		sd, sfs := effdump.New("sharded"), flag.NewFlagSet("sharded", flag.ContinueOnError)
+		sd.RegisterFlags(sfs)
+		sfs.Parse([]string{"-shard=3/3"})
+		index, count, err := sd.Shard()
+		fmt.Fprintf(inshard, "invalid spec: shard %d/%d (%v), InShard: %t\n", index, count, err, sd.InShard("all"))
+	}
+	d.Add("shard/inshard", inshard.String())
+	setdesc("save0", "Save a shard of the dump, save drops the effects of the other shards.")
+	p.Store, fetchVersion = shards, "v1"
+	run("-shard=0/3", "save")
+	setdesc("save1", "Save a shard of the dump.")
+	p.Store, p.Effects, fetchVersion = shards, shardeffects[1], "v1"
+	run("-shard=1/3", "save")
+	setdesc("merge-missing", "merge detects the missing shards.")
+	p.Store, fetchVersion = shards, "v1"
+	run("-shards=3", "merge")
+	setdesc("merge-no-count", "merge needs the number of the shards in the store.")
+	p.Store, fetchVersion = shards, "v1"
+	run("merge")
+	setdesc("save2", "Save the last shard of the dump.")
+	p.Store, p.Effects, fetchVersion = shards, shardeffects[2], "v1"
+	run("-shard=2/3", "save")
+	setdesc("save-stale", "Save a leftover shard of an earlier sharding.")
+	p.Store, p.Effects, fetchVersion = shards, shardeffects[0], "v1"
+	run("-shard=0/2", "save")
+	shardsdir := filepath.Join(tmpdir, "shards")
+	os.MkdirAll(shardsdir, 0o755)
+	var shardfiles []string
+	for i := 0; i < 3; i++ {
+		shardfiles = append(shardfiles, filepath.Join(shardsdir, fmt.Sprintf("shard%d.gz", i)))
+		os.WriteFile(shardfiles[i], shards[fmt.Sprintf("v1shard%dof3", i)], 0o644)
+	}
+	setdesc("merge-dirty", "merge refuses to save from a dirty workdir.")
+	p.Store, fetchVersion, fetchDirty = shards, "v1", true
+	run("-shards=3", "merge")
+	setdesc("merge", "merge combines the shards into the version, ignores the other shardings, and removes the merged shards.")
+	p.Store, fetchVersion = shards, "v1"
+	run("-shards=3", "merge")
+	var remaining []string
+	for v := range shards {
+		remaining = append(remaining, v)
+	}
+	slices.Sort(remaining)
+	d.Add("shard/merged-versions", strings.Join(remaining, "\n")+"\n") // only the stale shard remains next to v1
+	setdesc("diff-merged", "The merged version is the same as the unsharded one.")
+	p.Store, fetchVersion = shards, "v1"
+	run("diff")
+	setdesc("merge-nothing", "merge needs shards.")
+	p.Store, fetchVersion = shards, "v9"
+	run("-shards=3", "merge")
+	os.WriteFile(filepath.Join(shardsdir, "full.gz"), shards["v1"], 0o644)
+	setdesc("merge-files", "merge combines the shard files into the version and keeps the files.")
+	p.Store = shards
+	run("-version=files", "merge", shardfiles[0], shardfiles[1], shardfiles[2])
+	setdesc("merge-files-duplicate-shard", "merge detects the same shard given twice.")
+	p.Store = shards
+	run("-version=files", "merge", shardfiles[0], shardfiles[1], shardfiles[1])
+	setdesc("merge-files-unsharded", "merge rejects the dumps not saved with -shard.")
+	p.Store = shards
+	run("-version=files", "merge", shardfiles[0], filepath.Join(shardsdir, "full.gz"))
+	// save drops the keys of the other shards so only a dump from another source can have them.
+	duplicate := append([]keyvalue.KV{shardeffects[0][0]}, shardeffects[2]...)
+	slices.SortFunc(duplicate, func(a, b keyvalue.KV) int { return strings.Compare(a.K, b.K) })
+	if data, err := edmain.Compress(duplicate, '=', edmain.Hash(duplicate), &edmain.Manifest{Format: 6, Shard: "2/3"}, edmain.DefaultLimits); err == nil {
+		os.WriteFile(filepath.Join(shardsdir, "duplicate.gz"), data, 0o644)
+	}
+	setdesc("merge-wrong-shard", "merge detects the keys in the wrong shard.")
+	p.Store = shards
+	run("-version=files", "merge", shardfiles[0], shardfiles[1], filepath.Join(shardsdir, "duplicate.gz"))
+	setdesc("bad-spec", "-shard needs a valid spec.")
+	run("-shard=3/3", "save")
+	setdesc("long-version", "-shard checks the length of the shard's version name upfront.")
+	run("-version="+strings.Repeat("v", 60), "-shard=0/3", "save")
+	setdesc("merge-long-version", "-shards checks the length of the shards' version names upfront.")
+	run("-version="+strings.Repeat("v", 60), "-shards=3", "merge")
+	setdesc("diff", "-shard only works with save.")
+	run("-shard=0/3", "diff")
+
+	group = "partial-save"
+	partials := memstore{"v1": gz}
+	setdesc("merge", "Save only replaces the entries matching the globs.")
+	p.Store, p.Effects, fetchVersion = partials, edtextar.Parse(nil, testdata("numschanged.textar")), "v1"
+	run("save", "even*", "prime*")
+	setdesc("merged-keys", "The rest of the entries remain the same.")
+	p.Store, p.Effects, fetchVersion = partials, edtextar.Parse(nil, testdata("numschanged.textar")), "v1"
+	run("diffkeys")
+	setdesc("same", "Save is skipped if the matching entries didn't change.")
+	p.Store, p.Effects, fetchVersion = partials, edtextar.Parse(nil, testdata("numschanged.textar")), "v1"
+	run("save", "even*")
+	setdesc("new-version", "Partial save into a missing version is an error.")
+	p.Store, fetchVersion = partials, "v2"
+	run("save", "odd*")
+	setdesc("keyptr", "Save with -keyptr only replaces the entries matching the pointed globs.")
+	p.Store, p.Effects, fetchVersion = partials, append(edtextar.Parse(nil, testdata("numschanged.textar")), keyvalue.KV{"ptr", "odd*\n"}), "v1"
+	run("-keyptr=ptr", "save")
+	setdesc("keyptr-keys", "The rest of the entries remain the same.")
+	p.Store, p.Effects, fetchVersion = partials, edtextar.Parse(nil, testdata("numschanged.textar")), "v1"
+	run("diffkeys")
+	setdesc("limits", "The merged entries must be within the limits.")
+	p.Store, p.Limits, p.Effects, fetchVersion = partials, edmain.Limits{MaxEntries: 12}, []keyvalue.KV{{"new1", "1\n"}, {"new2", "2\n"}}, "v1"
+	run("save", "new*")
+
+	group = "concurrent"
+	concdir, errs, wg := filepath.Join(tmpdir, "concurrent"), make([]error, 8), sync.WaitGroup{}
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cp := edmain.Params{
+				Name:         "testdump",
+				Effects:      edtextar.Parse(nil, testdata([]string{"numsbase.textar", "numschanged.textar"}[i%2])),
+				Env:          []string{"EFFDUMP_DIR=" + concdir},
+				Stdout:       io.Discard,
+				Args:         []string{"save"},
+				Now:          baseParams.Now,
+				BuildInfo:    baseParams.BuildInfo,
+				VSHasChanges: func(context.Context) (bool, error) { return false, nil },
+			}
+			cp.RegisterFlags(flag.NewFlagSet("concurrent", flag.ContinueOnError))
+			cp.Sepch, cp.Version = "-", fmt.Sprintf("v%d", i%4)
+			errs[i] = cp.Run(ctx)
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		d.Add("concurrent/errors", err.Error())
+	}
+	files, _ := filepath.Glob(filepath.Join(concdir, "*"))
+	tempfiles, _ := filepath.Glob(filepath.Join(concdir, ".tmp-*"))
+	d.Add("concurrent/files", fmt.Sprintf("%d files, %d temp files\n", len(files), len(tempfiles)))
+	setdesc("fsck", "Concurrent saves leave no partial dumps behind.")
+	p.Env = []string{"EFFDUMP_DIR=" + concdir}
+	run("fsck")
+
 	group = "cmd-clear"
 	setdesc("with-args", "Clear cannot take args.")
 	run("clear", "somearg")
@@ -379,6 +889,754 @@ func mkdump() (*effdump.Dump, error) {
 	setdesc("empty", "Clear deletes nothing.")
 	run("clear")
 
+	group = "cmd-gc"
+	gcdir := filepath.Join(tmpdir, "gc")
+	gcsetup := func() {
+		// v1 is the newest, v5 is the oldest.
+		os.MkdirAll(gcdir, 0o755)
+		for i := 1; i <= 5; i++ {
+			fname := filepath.Join(gcdir, fmt.Sprintf("v%d.gz", i))
+			os.WriteFile(fname, gz, 0o644)
+			t := baseParams.Now().Add(-time.Duration(24*i-23) * time.Hour)
+			os.Chtimes(fname, t, t)
+		}
+		p.Env = []string{"EFFDUMP_DIR=" + gcdir}
+	}
+	setdesc("no-policy", "gc needs at least one policy.")
+	gcsetup()
+	run("gc")
+	setdesc("with-args", "gc doesn't take args.")
+	gcsetup()
+	run("-keep=1", "gc", "v1")
+	setdesc("keep", "Keep the 2 newest versions.")
+	gcsetup()
+	run("-keep=2", "gc")
+	setdesc("keep-all", "Keep more versions than available.")
+	gcsetup()
+	run("-keep=10", "gc")
+	setdesc("maxage", "Keep the versions younger than 60 hours.")
+	gcsetup()
+	run("-maxage=60h", "gc")
+	setdesc("keepdepth", "Keep the versions of the last 2 commits, the test's version system resolves everything to v4.")
+	gcsetup()
+	fetchVersion = "v4"
+	run("-keepdepth=2", "gc")
+	setdesc("combined", "A version is kept if any policy wants to keep it.")
+	gcsetup()
+	fetchVersion = "v5"
+	run("-keep=1", "-maxage=30h", "-keepdepth=1", "gc")
+	setdesc("no-modtimes", "-keep needs a store that tracks the save times.")
+	p.Store = memstore{}
+	run("-keep=1", "gc")
+
+	group = "cmd-fsck"
+	{
+		gzmember := func(comment, content string) []byte {
+			buf := &bytes.Buffer{}
+			w := gzip.NewWriter(buf)
+			w.Header.Comment = comment
+			io.WriteString(w, content)
+			w.Close()
+			return buf.Bytes()
+		}
+		ar := edtextar.Format(numsbase, '=')
+		legacyHash := fnv.New64() // the dumps saved before the digests hash the concatenated keys and values
+		for _, kv := range numsbase {
+			io.WriteString(legacyHash, kv.K+kv.V)
+		}
+		comment := fmt.Sprintf("effdump %d %d %016x", len(numsbase), len(ar), legacyHash.Sum64())
+		checksums := &strings.Builder{}
+		for _, kv := range numsbase {
+			fmt.Fprintf(checksums, "%016x\n", edmain.EntryHash(kv))
+		}
+		tampered := slices.Clone(numsbase)
+		tampered[1].V = strings.Replace(tampered[1].V, "3\n", "33\n", 1)
+		badhash, err := edmain.Compress(numsbase, '=', 42, nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress badhash: %v", err)
+		}
+		baddigest, err := edmain.Compress(numsbase, '=', edmain.Hash(numsbase), &edmain.Manifest{Format: 5, Hash: "sha256:00"}, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress baddigest: %v", err)
+		}
+		withmanifest, err := edmain.Compress(numsbase, '=', edmain.Hash(numsbase), &edmain.Manifest{Format: 6}, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress withmanifest: %v", err)
+		}
+		members, err := splitMembers(withmanifest)
+		if err != nil {
+			return nil, err
+		}
+		unsorted := append(slices.Clone(numsbase), keyvalue.KV{"aaa", "somevalue"})
+		badorder, err := edmain.Compress(unsorted, '=', edmain.Hash(unsorted), nil, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress badorder: %v", err)
+		}
+		fsckdir := filepath.Join(tmpdir, "fsck")
+		os.MkdirAll(fsckdir, 0o755)
+		for v, data := range map[string][]byte{
+			"good":        gz,
+			"old":         gzmember(comment, ar),
+			"badorder":    badorder,
+			"badhash":     badhash,
+			"baddigest":   baddigest,
+			"tampered":    append(gzmember(comment, edtextar.Format(tampered, '=')), gzmember("effdump checksums", checksums.String())...),
+			"truncated":   gz[:len(gz)/2],
+			"nochecksums": members[0],
+		} {
+			os.WriteFile(filepath.Join(fsckdir, v+".gz"), data, 0o644)
+		}
+
+		setdesc("report", "fsck reports the corrupted versions.")
+		p.Env = []string{"EFFDUMP_DIR=" + fsckdir}
+		run("fsck")
+		setdesc("diff-tampered", "diff also detects the checksum mismatch.")
+		p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + fsckdir}, "tampered"
+		run("diff")
+		setdesc("quarantine", "fsck -quarantine moves the corrupted versions out of the store.")
+		p.Env = []string{"EFFDUMP_DIR=" + fsckdir}
+		run("-quarantine", "fsck")
+		setdesc("clean", "fsck after the quarantine finds no corruption.")
+		p.Env = []string{"EFFDUMP_DIR=" + fsckdir}
+		run("fsck")
+		setdesc("with-args", "fsck doesn't take args.")
+		run("fsck", "good")
+		setdesc("diff-legacy-hash", "The dumps with the legacy hash remain readable.")
+		p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + fsckdir}, "old"
+		run("diff")
+		setdesc("save-legacy-hash", "Saving over a dump with the legacy hash rewrites it with a digest even if it looks the same.")
+		p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + fsckdir}, "old"
+		run("save")
+		setdesc("save-digest", "Saving over a dump with a matching digest is skipped.")
+		p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + fsckdir}, "old"
+		run("save")
+	}
+
+	group = "cmd-versions"
+	versionsdir := filepath.Join(tmpdir, "versions")
+	os.MkdirAll(versionsdir, 0o755)
+	sha256digest, _ := edmain.Digest(numsbase, edmain.HashSHA256)
+	withdigest, err := edmain.Compress(numsbase, '=', edmain.Hash(numsbase), &edmain.Manifest{Format: 6, Hash: sha256digest}, edmain.DefaultLimits)
+	if err != nil {
+		return nil, fmt.Errorf("effdumptest/compress withdigest: %v", err)
+	}
+	for i, v := range []string{"v1", "v2", "numsbase", "broken"} {
+		fname, data := filepath.Join(versionsdir, v+".gz"), gz
+		if v == "v2" {
+			data = withdigest
+		}
+		if v == "broken" {
+			data = []byte("garbage")
+		}
+		os.WriteFile(fname, data, 0o644)
+		t := time.Date(2024, 1, 10-i, 12, 0, 0, 0, time.UTC)
+		os.Chtimes(fname, t, t)
+	}
+	setdesc("table", "List the versions in a table, newest first.")
+	p.Env = []string{"EFFDUMP_DIR=" + versionsdir}
+	run("versions")
+	setdesc("json", "List the versions in JSON.")
+	p.Env = []string{"EFFDUMP_DIR=" + versionsdir}
+	run("-json", "versions")
+	setdesc("no-modtimes", "List the versions from a store that doesn't track the save times.")
+	p.Store = memstore{"v1": gz}
+	run("versions")
+	setdesc("empty", "List the versions of an empty store.")
+	p.Store = memstore{}
+	run("versions")
+	setdesc("with-args", "versions doesn't take args.")
+	run("versions", "v1")
+
+	group = "manifest"
+	setdesc("save-dirty", "Save the baseline from a dirty workdir.")
+	fetchVersion, fetchDirty = "dirtysave", true
+	run("-force", "save")
+	setdesc("diff-dirty", "The diff notes that the baseline is from a dirty workdir.")
+	fetchVersion, p.Effects = "dirtysave", edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diff", "even*")
+	setdesc("htmldiff-dirty", "The HTML diff shows the manifest too.")
+	fetchVersion, p.Effects = "dirtysave", edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("htmldiff", "even*")
+	setdesc("diff-toolchain", "The diff notes that the baseline is from a different toolchain.")
+	fetchVersion, p.Effects, goversion = "dirtysave", edtextar.Parse(nil, testdata("numschanged.textar")), "go2.0.0"
+	run("diff", "even*")
+	goversion = "go1.99.0"
+	{
+		// The extra field must be a list of RFC 1952 subfields.
+		w := &strings.Builder{}
+		f, err := os.Open(filepath.Join(tmpdir, "dirtysave.gz"))
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/open dirtysave.gz: %v", err)
+		}
+		r, err := gzip.NewReader(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/read dirtysave.gz: %v", err)
+		}
+		for extra := r.Header.Extra; len(extra) >= 4; {
+			n := int(extra[2]) | int(extra[3])<<8
+			fmt.Fprintf(w, "subfield %q: %d bytes, %d available\n", extra[:2], n, len(extra)-4)
+			extra = extra[min(4+n, len(extra)):]
+		}
+		d.Add("manifest/extra-field", w.String())
+	}
+	{
+		// The dumps saved before format 6 have the raw JSON as the extra field.
+		members, err := splitMembers(gz)
+		if err != nil {
+			return nil, err
+		}
+		r, err := gzip.NewReader(bytes.NewReader(members[0]))
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/read numsbase: %v", err)
+		}
+		buf := &bytes.Buffer{}
+		gw := gzip.NewWriter(buf)
+		gw.Header.Comment = r.Header.Comment
+		gw.Header.Extra = []byte(`{"format":5,"saveTime":"2024-01-01T00:00:00Z","goVersion":"go1.22.0","flags":["-sepch=="]}`)
+		io.WriteString(gw, edtextar.Format(numsbase, '='))
+		gw.Close()
+		buf.Write(members[1])
+		setdesc("legacy-extra", "The dumps with the raw JSON manifest in the extra field are still readable.")
+		p.Store, p.Effects = memstore{"numsbase": buf.Bytes()}, edtextar.Parse(nil, testdata("numschanged.textar"))
+		run("diff", "even*")
+	}
+
+	group = "limits"
+	setdesc("save-over-entries", "save rejects dumps with more entries than the limit.")
+	p.Limits = edmain.Limits{MaxEntries: 5}
+	run("-version=limited", "save")
+	setdesc("save-over-bytes", "save rejects dumps larger than the limit.")
+	p.Limits = edmain.Limits{MaxBytes: 100}
+	run("-version=limited", "save")
+	setdesc("save-within", "save accepts dumps within the limits.")
+	run("-version=limited", "save")
+	setdesc("diff-over-entries", "diff rejects baselines with more entries than the limit.")
+	p.Limits = edmain.Limits{MaxEntries: 5}
+	run("-version=limited", "diff")
+	setdesc("save-raised", "save accepts large dumps with raised limits.")
+	p.Limits = edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}
+	p.Effects = nil
+	for i := 0; i < 20000; i++ {
+		p.Effects = append(p.Effects, keyvalue.KV{fmt.Sprintf("key%05d", i), fmt.Sprintf("%0100d\n", i)})
+	}
+	run("-version=large", "save")
+	setdesc("diff-raised", "diff works on large dumps with raised limits.")
+	p.Limits = edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}
+	p.Effects = nil
+	for i := 0; i < 20000; i++ {
+		p.Effects = append(p.Effects, keyvalue.KV{fmt.Sprintf("key%05d", i), fmt.Sprintf("%0100d\n", i/2*2)})
+	}
+	run("-version=large", "diffkeys", "key0000*")
+	{
+		large, err := os.ReadFile(filepath.Join(tmpdir, "large.gz"))
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/read large.gz: %v", err)
+		}
+		members, err := splitMembers(large)
+		if err != nil {
+			return nil, err
+		}
+		setdesc("diff-first-shard", "diff rejects a sharded dump cut off after its first shard.")
+		p.Limits, p.Store = edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}, memstore{"large": members[0]}
+		run("-version=large", "diffkeys", "key0000*")
+		setdesc("diff-missing-shard", "diff rejects a sharded dump with a missing shard even if the checksums member is there.")
+		p.Limits, p.Store = edmain.Limits{MaxEntries: 1e5, MaxBytes: 1e8}, memstore{"large": append(slices.Clone(members[0]), members[len(members)-1]...)}
+		run("-version=large", "diffkeys", "key0000*")
+		d.Add("limits/large-members", fmt.Sprintf("%d gzip members\n", len(members)))
+	}
+	os.Remove(filepath.Join(tmpdir, "large.gz"))
+
+	group = "archive"
+	archives := memstore{"numsbase": gz}
+	archivedir := filepath.Join(tmpdir, "archives")
+	os.MkdirAll(archivedir, 0o755)
+	setdesc("export", "Export a saved version into a plain textar.")
+	p.Store = archives
+	run("export", "numsbase", filepath.Join(archivedir, "exported.textar"))
+	setdesc("export-gz", "Export a saved version into a gzip compressed textar.")
+	p.Store = archives
+	run("export", "numsbase", filepath.Join(archivedir, "numsbase.textar.gz"))
+	setdesc("export-stdout", "Export a saved version to stdout.")
+	p.Store = archives
+	run("export", "numsbase", "-")
+	setdesc("export-missing", "Exporting a missing version fails.")
+	p.Store = archives
+	run("export", "nosuch", filepath.Join(archivedir, "nosuch.textar"))
+	setdesc("export-args", "export needs a version and a file.")
+	p.Store = archives
+	run("export", "numsbase")
+	setdesc("import", "Import an archive under its file name.")
+	p.Store = archives
+	run("import", filepath.Join(archivedir, "exported.textar"))
+	setdesc("import-gz", "Import a gzip compressed archive under a custom name.")
+	p.Store = archives
+	run("-version=fromgz", "import", filepath.Join(archivedir, "numsbase.textar.gz"))
+	setdesc("import-existing", "Importing doesn't overwrite versions by default.")
+	p.Store = archives
+	run("-version=fromgz", "import", filepath.Join(archivedir, "numsbase.textar.gz"))
+	setdesc("import-force", "Importing overwrites versions with -force.")
+	p.Store = archives
+	run("-version=fromgz", "-force", "import", filepath.Join(archivedir, "numsbase.textar.gz"))
+	setdesc("diff-imported", "Diff against an imported version.")
+	p.Store, p.Effects = archives, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("-version=fromgz", "diff", "even*")
+	os.WriteFile(filepath.Join(archivedir, "unsorted.textar"), []byte("=== b\n2\n=== a\n1\n"), 0o644)
+	os.WriteFile(filepath.Join(archivedir, "dup.textar"), []byte("=== a\n1\n=== a\n2\n"), 0o644)
+	os.WriteFile(filepath.Join(archivedir, "bad-name.textar"), []byte("=== a\n1\n"), 0o644)
+	setdesc("import-unsorted", "Importing rejects unsorted keys.")
+	p.Store = archives
+	run("import", filepath.Join(archivedir, "unsorted.textar"))
+	setdesc("import-duplicate", "Importing rejects duplicate keys.")
+	p.Store = archives
+	run("import", filepath.Join(archivedir, "dup.textar"))
+	setdesc("import-limits", "Importing rejects archives over the limits.")
+	p.Store, p.Limits = archives, edmain.Limits{MaxEntries: 5}
+	run("-version=limited", "import", filepath.Join(archivedir, "exported.textar"))
+	setdesc("import-bad-name", "Importing needs -version if the file name isn't a valid version.")
+	p.Store = archives
+	run("import", filepath.Join(archivedir, "bad-name.textar"))
+	setdesc("versions", "The imported versions are regular versions.")
+	p.Store = archives
+	run("versions")
+
+	group = "tree"
+	treekvs := []keyvalue.KV{{"", "empty key\n"}, {"../escape", "dotdot\n"}, {".", "dot\n"}, {"100%", "percent\n"}, {"a", "a is a dir too\n"}, {"a/b", "ab\n"}, {"diffs/foo.html", "<p>foo</p>\n"}, {"dir/", "trailing slash\n"}, {"with space", "space\n"}, {"x//y", "double slash\n"}}
+	treedir := filepath.Join(tmpdir, "trees", "tree")
+	setdesc("materialize", "Materialize effects with keys that need escaping.")
+	p.Effects = treekvs
+	run("materialize", treedir)
+	treefiles := &strings.Builder{}
+	filepath.WalkDir(treedir, func(fname string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(treedir, fname)
+			fmt.Fprintln(treefiles, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	d.Add("tree/materialized-files", treefiles.String())
+	setdesc("materialize-nonempty", "Materializing into a non-empty directory fails.")
+	p.Effects = treekvs
+	run("materialize", treedir)
+	setdesc("materialize-args", "materialize needs exactly one directory.")
+	run("materialize")
+	setdesc("ingest", "Ingest a materialized tree under the directory's name.")
+	run("ingest", treedir)
+	setdesc("diff-ingested", "The ingested version matches the materialized effects.")
+	p.Effects = treekvs
+	run("-version=tree", "diff")
+	setdesc("ingest-existing", "Ingesting doesn't overwrite versions by default.")
+	run("ingest", treedir)
+	setdesc("materialize-saved", "Materialize a saved version with -to.")
+	p.Store = memstore{"numsbase": gz}
+	run("-to=numsbase", "materialize", filepath.Join(tmpdir, "trees", "numsbase"))
+	baddir := filepath.Join(tmpdir, "trees", "bad")
+	os.MkdirAll(baddir, 0o755)
+	os.WriteFile(filepath.Join(baddir, "a%2f"), []byte("lowercase hex\n"), 0o644)
+	setdesc("ingest-noncanonical", "Ingesting rejects the file names that materialize doesn't generate.")
+	run("ingest", baddir)
+	lonedir := filepath.Join(tmpdir, "trees", "lone")
+	os.MkdirAll(filepath.Join(lonedir, "a"), 0o755)
+	os.WriteFile(filepath.Join(lonedir, "a", "%%"), []byte("a alone\n"), 0o644)
+	setdesc("ingest-lone-index", "Ingesting rejects a/%% if a has no other entries because a is the same key.")
+	run("ingest", lonedir)
+	middir := filepath.Join(tmpdir, "trees", "mid")
+	os.MkdirAll(filepath.Join(middir, "a", "%%"), 0o755)
+	os.WriteFile(filepath.Join(middir, "a", "%%", "b"), []byte("index in the middle\n"), 0o644)
+	setdesc("ingest-mid-index", "Ingesting rejects %% anywhere else than the last segment.")
+	run("ingest", middir)
+	setdesc("ingest-missing", "Ingesting a missing directory fails.")
+	run("ingest", filepath.Join(tmpdir, "trees", "nosuch"))
+
+	group = "diff-from-to"
+	fromto := memstore{}
+	for _, v := range []struct{ version, file, goversion string }{{"old", "numsbase", "go1.98.0"}, {"new", "numschanged", "go1.99.0"}} {
+		kvs := edtextar.Parse(nil, testdata(v.file+".textar"))
+		m := &edmain.Manifest{Format: 2, SaveTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), GoVersion: v.goversion}
+		gz, err := edmain.Compress(kvs, '=', edmain.Hash(kvs), m, edmain.DefaultLimits)
+		if err != nil {
+			return nil, fmt.Errorf("effdumptest/compress %s: %v", v.version, err)
+		}
+		fromto[v.version] = gz
+	}
+	setdesc("diff", "Diff two saved versions.")
+	p.Store = fromto
+	run("-from=old", "-to=new", "diff", "even*")
+	setdesc("diffkeys", "List the changed keys between two saved versions.")
+	p.Store = fromto
+	run("-from=old", "-to=new", "diffkeys")
+	setdesc("htmldiff", "HTML diff of two saved versions describes both sides.")
+	p.Store = fromto
+	run("-from=old", "-to=new", "htmldiff", "even*")
+	setdesc("reverse", "Diff two saved versions in reverse.")
+	p.Store = fromto
+	run("-from=new", "-to=old", "diffkeys")
+	setdesc("to-only", "Diff the HEAD's version against a saved version.")
+	p.Store, fetchVersion = fromto, "old"
+	run("-to=new", "diffkeys")
+	setdesc("from-revision", "-from resolves revisions through the version control system.")
+	p.Store, fetchVersion = fromto, "old"
+	run("-from=HEAD~1", "diffkeys")
+	setdesc("from-unknown", "-from reports unknown versions.")
+	p.Store = fromto
+	p.VSResolve = func(context.Context, string) (string, error) { return "", fmt.Errorf("unknown revision") }
+	run("-from=nosuch", "diffkeys")
+	setdesc("to-missing", "-to reports revisions without a saved version.")
+	p.Store, fetchVersion = fromto, "missing"
+	run("-from=old", "-to=HEAD", "diffkeys")
+	setdesc("from-with-version", "-from can't be combined with -version.")
+	p.Store = fromto
+	run("-from=old", "-version=new", "diffkeys")
+	setdesc("save", "save rejects -to before resolving or loading it.")
+	p.Store = fromto
+	run("-to=new", "save")
+
+	group = "golden"
+	golden := filepath.Join(tmpdir, "golden.textar")
+	setdesc("no-golden", "check needs a golden file.")
+	run("check")
+	setdesc("check-missing", "check fails if the golden file doesn't exist yet.")
+	p.Golden = golden
+	run("check")
+	setdesc("update-with-args", "update always writes the full golden file.")
+	p.Golden = golden
+	run("update", "even*")
+	setdesc("update-with-keyptr", "update doesn't accept -keyptr: it would write only the selected effects.")
+	p.Golden = golden
+	run("-keyptr=all", "update")
+	setdesc("update-with-to", "update doesn't accept -to: it would write another version's effects.")
+	p.Golden = golden
+	run("-to=numsbase", "update")
+	setdesc("update", "update creates the golden file.")
+	p.Golden = golden
+	run("update")
+	setdesc("update-again", "update notes if the golden file is already up to date.")
+	p.Golden = golden
+	run("update")
+	setdesc("check", "check passes if the golden file matches the current version.")
+	run("-golden="+golden, "check")
+	setdesc("check-changed", "check fails with the diff if the golden file differs.")
+	p.Golden, p.Effects = golden, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("check", "even*", "odd*")
+	setdesc("diff", "diff uses the golden file as the baseline too.")
+	p.Golden, p.Effects = golden, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diffkeys")
+	setdesc("with-from", "-from can't be combined with -golden.")
+	p.Golden = golden
+	run("-from=numsbase", "diff")
+	setdesc("update-changed", "update accepts the changes.")
+	p.Golden, p.Effects = golden, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("update")
+	if ar, err := os.ReadFile(golden); err != nil {
+		return nil, fmt.Errorf("effdumptest/read golden: %v", err)
+	} else {
+		d.Add("golden/file", string(ar))
+	}
+	setdesc("check-reverted", "check reports the changes of the golden file.")
+	p.Golden = golden
+	run("check", "even*")
+	setdesc("unsorted", "check reports hand-edited golden files with bad key order.")
+	os.WriteFile(golden, []byte("=== b\n2\n=== a\n1\n"), 0o644)
+	p.Golden = golden
+	run("check")
+
+	group = "custom-store"
+	mem := memstore{}
+	setdesc("diff-missing", "Diffing against an empty custom store.")
+	p.Store = mem
+	run("diff")
+	setdesc("save", "Save into the custom store.")
+	p.Store = mem
+	run("save")
+	setdesc("diff", "Diffing against the custom store's version.")
+	p.Store, p.Effects = mem, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diff", "even*")
+	setdesc("clear", "Clear deletes from the custom store.")
+	p.Store = mem
+	run("clear")
+
+	group = "git-store"
+	gitdir := filepath.Join(tmpdir, "gitrepo")
+	if output, err := exec.Command("git", "init", "-q", gitdir).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("effdumptest/git init: %v\n%s", err, output)
+	}
+	gitstore := git.NewStore(gitdir, "testdump")
+	setdesc("bad-mode", "EFFDUMP_STORE must be a known store.")
+	p.Env = append(p.Env, "EFFDUMP_STORE=bogus")
+	run("diff")
+	setdesc("diff-missing", "Diffing against an empty git store.")
+	p.Store = gitstore
+	run("diff")
+	setdesc("save", "Save into the git store.")
+	p.Store = gitstore
+	run("save")
+	setdesc("save-again", "Save into the git store with the same content is skipped.")
+	p.Store = gitstore
+	run("save")
+	setdesc("diff", "Diffing against the git store's version.")
+	p.Store, p.Effects = gitstore, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diff", "even*")
+	setdesc("clear", "Clear deletes the refs from the git store.")
+	p.Store = gitstore
+	run("clear")
+	setdesc("not-a-repo", "Failing to look up a ref for other reasons than a missing ref is a real error, not a missing version.")
+	norepo := filepath.Join(tmpdir, "norepo")
+	if err := os.Mkdir(norepo, 0o755); err != nil {
+		return nil, fmt.Errorf("effdumptest/make norepo dir: %v", err)
+	}
+	p.Store = git.NewStore(norepo, "testdump")
+	run("diff")
+
+	group = "delta"
+	deltas := memstore{"v1": gz}
+	revs := func(m map[string]string) func(context.Context, string) (string, error) {
+		return func(_ context.Context, ref string) (string, error) {
+			if v, ok := m[ref]; ok {
+				return v, nil
+			}
+			return "", fmt.Errorf("unknown revision %q", ref)
+		}
+	}
+	edited := slices.DeleteFunc(edtextar.Parse(nil, testdata("numsbase.textar")), func(kv keyvalue.KV) bool { return kv.K == "composite" })
+	edited = append(edited, keyvalue.KV{"new", "a new entry\n"})
+	for i := range edited {
+		if edited[i].K == "even" {
+			edited[i].V = "2\n4\n6\n8\n10\n"
+		}
+	}
+	slices.SortFunc(edited, func(a, b keyvalue.KV) int { return strings.Compare(a.K, b.K) })
+	setdesc("save", "Save a delta against the parent revision's dump.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v2", "HEAD^": "v1"})
+	run("-delta=1", "save")
+	setdesc("versions", "versions shows the entry count and the size of the rebuilt delta dumps.")
+	p.Store = deltas
+	run("versions")
+	setdesc("diff", "Diffing against a delta rebuilds it from its parent.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v2"})
+	run("diff")
+	setdesc("diff-from-to", "Diff a delta against its parent.")
+	p.Store = deltas
+	run("-from=v1", "-to=v2", "diff")
+	setdesc("save-chain-limit", "Save a full dump after -delta deltas in a row.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v3", "HEAD^": "v2"})
+	run("-delta=1", "save")
+	setdesc("save-chain", "Save a delta of a delta.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v4", "HEAD^": "v2"})
+	run("-delta=2", "save")
+	setdesc("save-large-change", "Save a full dump if most entries changed.")
+	p.Store, p.Effects, p.VSResolve = deltas, edtextar.Parse(nil, testdata("numschanged.textar")), revs(map[string]string{"": "v5", "HEAD^": "v1"})
+	run("-delta=5", "save")
+	setdesc("save-no-parent", "Save a full dump if the parent isn't saved.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v6", "HEAD^": "v0"})
+	run("-delta=5", "save")
+	setdesc("export", "Export rebuilds the delta dumps.")
+	p.Store = deltas
+	run("export", "v4", "-")
+	setdesc("fsck", "fsck verifies the rebuilt delta dumps.")
+	p.Store = deltas
+	run("fsck")
+	brokendeltas := memstore{"v2": deltas["v2"]}
+	brokenchain := memstore{"v2": deltas["v2"], "v4": deltas["v4"]}
+	setdesc("gc-rev", "-keepdepth counts the commits back from -rev.")
+	p.Store, p.VSResolve = maps.Clone(deltas), revs(map[string]string{"": "v4", "HEAD~0": "v4", "v2rev": "v2", "v2rev~0": "v2", "v2rev~1": "v1"})
+	run("-rev=v2rev", "-keepdepth=2", "gc")
+	setdesc("gc", "gc rewrites the deltas of the removed versions as full dumps.")
+	p.Store, p.VSResolve = deltas, revs(map[string]string{"": "v4", "HEAD~0": "v4"})
+	run("-keepdepth=1", "gc")
+	setdesc("diff-after-gc", "The rewritten dumps stay the same.")
+	p.Store, p.Effects, p.VSResolve = deltas, edited, revs(map[string]string{"": "v4"})
+	run("diff")
+	setdesc("missing-parent", "Loading a delta fails if its parent is missing.")
+	p.Store, p.Effects, p.VSResolve = brokendeltas, edited, revs(map[string]string{"": "v2"})
+	run("diff")
+	setdesc("fsck-missing-parent", "fsck reports the deltas with missing parents.")
+	p.Store = brokendeltas
+	run("fsck")
+	setdesc("gc-broken-chain", "gc skips and reports the children it can't rebuild and removes the rest.")
+	p.Store, p.VSResolve = brokenchain, revs(map[string]string{"": "v4", "HEAD~0": "v4"})
+	run("-keepdepth=1", "gc")
+	qdir := filepath.Join(tmpdir, "deltaquarantine")
+	setdesc("save-corrupted-parent", "Save a parent for the quarantine test.")
+	p.Env, p.VSResolve = []string{"EFFDUMP_DIR=" + qdir}, revs(map[string]string{"": "v1"})
+	run("save")
+	setdesc("save-child-of-corrupted", "Save a delta whose parent gets corrupted.")
+	p.Env, p.Effects, p.VSResolve = []string{"EFFDUMP_DIR=" + qdir}, edited, revs(map[string]string{"": "v2", "HEAD^": "v1"})
+	run("-delta=1", "save")
+	if badhash, err := edmain.Compress(numsbase, '=', 42, nil, edmain.DefaultLimits); err == nil {
+		os.WriteFile(filepath.Join(qdir, "v1.gz"), badhash, 0o644)
+	}
+	setdesc("quarantine-parent", "fsck -quarantine rewrites the readable children of a corrupted parent as full dumps first.")
+	p.Env = []string{"EFFDUMP_DIR=" + qdir}
+	run("-quarantine", "fsck")
+	setdesc("diff-quarantined-parent", "The child remains readable after its parent was quarantined.")
+	p.Env, p.Effects, p.VSResolve = []string{"EFFDUMP_DIR=" + qdir}, edited, revs(map[string]string{"": "v2"})
+	run("diff")
+	overwritten := memstore{"v1": gz}
+	setdesc("save-child", "Save a delta for the overwrite tests.")
+	p.Store, p.Effects, p.VSResolve = overwritten, edited, revs(map[string]string{"": "v2", "HEAD^": "v1"})
+	run("-delta=1", "save")
+	setdesc("overwrite-parent", "Overwriting a version rewrites its delta children as full dumps first.")
+	p.Store, p.Effects, p.VSResolve = overwritten, edtextar.Parse(nil, testdata("numschanged.textar")), revs(map[string]string{"": "v1"})
+	run("save")
+	setdesc("diff-overwritten-parent", "The child remains readable after its parent was overwritten.")
+	p.Store, p.Effects, p.VSResolve = overwritten, edited, revs(map[string]string{"": "v2"})
+	run("diff")
+	if r, err := gzip.NewReader(bytes.NewReader(overwritten["v2"])); err == nil {
+		ar, _ := io.ReadAll(r)
+		line, _, _ := strings.Cut(string(ar), "\n")
+		d.Add(group+"/rewritten-separator", line+"\n")
+	}
+	small, large := strings.Repeat("a", 40)+"\n", strings.Repeat("b", 40)+"\n"
+	grown := memstore{}
+	setdesc("save-grown-parent", "Save a parent for the rebuilt size limit test.")
+	p.Store, p.Effects, p.VSResolve = grown, []keyvalue.KV{{"a", small}}, revs(map[string]string{"": "v1"})
+	run("save")
+	setdesc("save-grown", "Save a delta that doubles its parent.")
+	p.Store, p.Effects, p.VSResolve = grown, []keyvalue.KV{{"a", small}, {"b", large}}, revs(map[string]string{"": "v2", "HEAD^": "v1"})
+	run("-delta=1", "save")
+	setdesc("diff-grown-over-bytes", "The rebuilt dump must fit the byte limit even if its parts do.")
+	p.Store, p.Limits, p.Effects, p.VSResolve = grown, edmain.Limits{MaxBytes: 60}, []keyvalue.KV{{"a", small}}, revs(map[string]string{"": "v3"})
+	run("-from=v2", "diff")
+
+	group = "cas-store"
+	casdir := filepath.Join(tmpdir, "cas")
+	casenv := []string{"EFFDUMP_DIR=" + casdir, "EFFDUMP_STORE=cas"}
+	countObjects := func(name string) {
+		objects, _ := filepath.Glob(filepath.Join(casdir, "objects", "*", "*"))
+		d.Add(fmt.Sprintf("%s/%s", group, name), fmt.Sprintf("%d objects\n", len(objects)))
+	}
+	setdesc("save", "Save into the content-addressed store.")
+	p.Env = casenv
+	run("-version=v1", "save")
+	countObjects("objects-v1")
+	setdesc("save-again", "Saving the same content is skipped.")
+	p.Env = casenv
+	run("-version=v1", "save")
+	setdesc("save-changed", "Save a changed version, only its new values are stored.")
+	p.Env, p.Effects = casenv, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("-version=v2", "save")
+	countObjects("objects-v2")
+	setdesc("save-duplicates", "Identical values under different keys are stored once.")
+	p.Env, p.Effects = casenv, []keyvalue.KV{{"berlin", "replicas: 3\n"}, {"paris", "replicas: 3\n"}, {"tokyo", "replicas: 3\n"}}
+	run("-version=v3", "save")
+	countObjects("objects-v3")
+	setdesc("diff", "Diff against a version from the content-addressed store.")
+	p.Env, p.Effects = casenv, edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("-version=v1", "diff", "even*")
+	setdesc("diff-over-entries", "The index is rejected if it has more entries than the limit.")
+	p.Env, p.Limits = casenv, edmain.Limits{MaxEntries: 5}
+	run("-version=v1", "diff", "even*")
+	setdesc("diff-over-bytes", "The values are read only up to the size limit.")
+	p.Env, p.Limits = casenv, edmain.Limits{MaxBytes: 100}
+	run("-version=v1", "diff", "even*")
+	setdesc("fsck", "fsck verifies the reconstructed dumps.")
+	p.Env = casenv
+	run("fsck")
+	for i, v := range []string{"v1", "v2", "v3"} {
+		t := time.Date(2024, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(filepath.Join(casdir, v+".idx"), t, t)
+	}
+	setdesc("gc", "gc prunes the values only the deleted versions referenced.")
+	p.Env = casenv
+	run("-keep=2", "gc")
+	countObjects("objects-gc")
+	setdesc("corrupted", "fsck detects corrupted values.")
+	if objects, _ := filepath.Glob(filepath.Join(casdir, "objects", "*", "*")); len(objects) > 0 {
+		os.WriteFile(objects[0], []byte("garbage"), 0o644)
+	}
+	p.Env = casenv
+	run("fsck")
+	setdesc("clear", "clear deletes the values too.")
+	p.Env = casenv
+	run("clear")
+	if _, err := os.Stat(casdir); err == nil {
+		d.Add("cas-store/clear-leftovers", "the cas directory still exists\n")
+	}
+
+	group = "remote-store"
+	storeHandler, srvlog := edmain.StoreHandler(filepath.Join(tmpdir, "server"), edmain.DefaultLimits), &strings.Builder{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(srvlog, "%s %s range=%q\n", req.Method, req.URL.Path, req.Header.Get("Range"))
+		storeHandler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	remoteURL = srv.URL
+	setdesc("save", "Save uploads to the remote too.")
+	p.Env = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local1"), "EFFDUMP_REMOTE=" + srv.URL}
+	run("save")
+	setdesc("diff-fetch", "Diff fetches the missing baseline from the remote.")
+	p.Env = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local2"), "EFFDUMP_REMOTE=" + srv.URL}
+	p.Effects = edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diff", "even*")
+	setdesc("diff-cached", "The fetched baseline is cached locally.")
+	p.Env = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local2")}
+	p.Effects = edtextar.Parse(nil, testdata("numschanged.textar"))
+	run("diff", "even*")
+	setdesc("diff-missing", "Diffing against a baseline missing from the remote too.")
+	p.Env = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local2"), "EFFDUMP_REMOTE=" + srv.URL}
+	fetchVersion = "nonexistent"
+	run("diff")
+	{
+		w := &strings.Builder{}
+		request := func(method, path, body string) {
+			req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				fmt.Fprintf(w, "%s %s: %v\n", method, path, err)
+				return
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if strings.HasSuffix(path, ".gz") && resp.StatusCode == http.StatusOK && method == http.MethodGet {
+				data = []byte("(the compressed dump)\n")
+			}
+			fmt.Fprintf(w, "%s %s: %s\n%s\n", method, path, resp.Status, data)
+		}
+		request("GET", "/testdump/", "")
+		request("GET", "/testdump/numsbase.gz", "")
+		request("GET", "/testdump/nonexistent.gz", "")
+		request("GET", "/testdump/../numsbase.gz", "")
+		request("GET", "/testdump/numsbase", "")
+		request("PUT", "/testdump/garbage.gz", "garbage")
+		request("DELETE", "/testdump/numsbase.gz", "")
+		d.Add("remote-store/server-requests", w.String())
+	}
+	{
+		big := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(make([]byte, 2<<20)) }))
+		store, w := edmain.NewHTTPStore(big.URL, "testdump", edmain.Limits{MaxEntries: 1, MaxBytes: 1}), &strings.Builder{}
+		_, err := store.Get(ctx, "v1")
+		fmt.Fprintf(w, "Get: %v\n", err)
+		fmt.Fprintf(w, "Put: %v\n", store.Put(ctx, "v1", make([]byte, 2<<20)))
+		big.Close()
+		d.Add("remote-store/over-limit", strings.ReplaceAll(w.String(), big.URL, "http://remote"))
+	}
+	setdesc("save-local-only", "Save a version without the remote.")
+	p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local3")}, "v1"
+	run("save")
+	setdesc("save-upload-cached", "Save uploads the version even if it's already saved locally but it's missing from the remote.")
+	p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local3"), "EFFDUMP_REMOTE=" + srv.URL}, "v1"
+	run("save")
+	setdesc("save-again", "Save skips the upload if the remote has the same version.")
+	p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local3"), "EFFDUMP_REMOTE=" + srv.URL}, "v1"
+	srvlog.Reset()
+	run("save")
+	d.Add("remote-store/save-again-requests", srvlog.String()) // only the header is downloaded
+	setdesc("save-changed", "Save uploads a changed version without downloading the old one.")
+	p.Env, p.Effects, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "local3"), "EFFDUMP_REMOTE=" + srv.URL}, edtextar.Parse(nil, testdata("numschanged.textar")), "v1"
+	srvlog.Reset()
+	run("save")
+	d.Add("remote-store/save-changed-requests", srvlog.String())
+	for i := 0; i < 2; i++ {
+		setdesc(fmt.Sprintf("save-shard%d", i), "Save a shard from its own machine.")
+		p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, fmt.Sprintf("shardhost%d", i)), "EFFDUMP_REMOTE=" + srv.URL}, "v2"
+		p.Effects = slices.DeleteFunc(slices.Clone(numsbase), func(kv keyvalue.KV) bool { return edmain.ShardOf(kv.K, 2) != i })
+		run(fmt.Sprintf("-shard=%d/2", i), "save")
+	}
+	setdesc("merge", "merge fetches the shards from the remote.")
+	p.Env, fetchVersion = []string{"EFFDUMP_DIR=" + filepath.Join(tmpdir, "merger"), "EFFDUMP_REMOTE=" + srv.URL}, "v2"
+	run("-shards=2", "merge")
+	remoteURL = ""
+
 	return d, nil
 }
 
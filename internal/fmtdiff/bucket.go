@@ -1,16 +1,35 @@
 package fmtdiff
 
-import "github.com/ypsu/effdump/internal/andiff"
+import (
+	"github.com/ypsu/effdump/internal/andiff"
+	"github.com/ypsu/effdump/internal/jsondiff"
+)
 
 // Entry is a andiff.Diff with a name associated.
 type Entry struct {
 	Name    string
 	Comment string
 	Diff    andiff.Diff
+	JSON    []jsondiff.Change // the structural changes, non-nil only for the JSON values with -jsondiff
 }
 
 // Bucket contains Diffs that hash to the same value.
 type Bucket struct {
 	Hash    uint64
 	Entries []Entry
+
+	// The near-identical buckets Cluster merged into this one.
+	Similar []Bucket
+
+	// The similarity of this bucket's changed lines to the bucket it's merged into, between 0 and 1.
+	Similarity float64
+}
+
+// Len returns the number of entries in the bucket including the similar buckets' entries.
+func (b Bucket) Len() int {
+	n := len(b.Entries)
+	for _, s := range b.Similar {
+		n += len(s.Entries)
+	}
+	return n
 }
@@ -0,0 +1,76 @@
+package fmtdiff
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/ypsu/effdump/internal/andiff"
+)
+
+// shingles returns the set of the word bigrams of the diff's changed lines.
+// The words are the runs of letters, digits, and underscores; a line with a single word contributes that word.
+// Each shingle is prefixed with the side of its line so that a deletion doesn't match an addition.
+func shingles(d andiff.Diff) map[string]bool {
+	set := map[string]bool{}
+	add := func(side, line string) {
+		words := strings.FieldsFunc(line, func(r rune) bool { return r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		if len(words) == 1 {
+			set[side+words[0]] = true
+		}
+		for i := 1; i < len(words); i++ {
+			set[side+words[i-1]+" "+words[i]] = true
+		}
+	}
+	xi, yi := 0, 0
+	for _, op := range d.Ops {
+		for _, line := range d.LT[xi : xi+op.Del] {
+			add("-", line)
+		}
+		for _, line := range d.RT[yi : yi+op.Add] {
+			add("+", line)
+		}
+		xi, yi = xi+op.Del+op.Keep, yi+op.Add+op.Keep
+	}
+	return set
+}
+
+// jaccard returns the Jaccard index of two sets: the size of their intersection divided by the size of their union.
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for s := range a {
+		if b[s] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// Cluster merges each bucket into the most similar earlier bucket if their changed lines are at least threshold similar.
+// The similarity is the Jaccard index of the word bigrams of the buckets' first diffs' changed lines.
+// The merged buckets become the Similar buckets of the bucket they are merged into so their own diffs remain available.
+func Cluster(buckets []Bucket, threshold float64) []Bucket {
+	var clusters []Bucket
+	var sets []map[string]bool
+	for _, b := range buckets {
+		set, best, bestsim := shingles(b.Entries[0].Diff), -1, 0.0
+		for i, cs := range sets {
+			// The Jaccard index can't be above the ratio of the set sizes, skip the hopeless pairs.
+			if float64(min(len(set), len(cs))) < threshold*float64(max(len(set), len(cs))) {
+				continue
+			}
+			if sim := jaccard(set, cs); sim >= threshold && sim > bestsim {
+				best, bestsim = i, sim
+			}
+		}
+		if best < 0 {
+			clusters, sets = append(clusters, b), append(sets, set)
+			continue
+		}
+		b.Similarity = bestsim
+		clusters[best].Similar = append(clusters[best].Similar, b)
+	}
+	return clusters
+}
@@ -17,6 +17,7 @@ function expandall(evt) {
 function unify(evt) {
   evt.target.hidden = true
   for (let table of document.getElementsByTagName('table')) {
+    if (table.classList.contains('cJSON')) continue
     let t = ''
     let add = ''
     for (let row of table.tBodies[0].childNodes) {
@@ -37,17 +38,21 @@ function unify(evt) {
         t += `<td class=cUnified>` + row.children[3].innerHTML
         add = ''
       }
-      if (row.children[1].className == 'cLeft cbgNegative') {
+      let left = row.children[1].classList
+      if (left.contains('cbgNegative') || left.contains('cbgMoved')) {
+        let bg = left[1]
         t += `<tr>`
-        t += `<td class="cNum cbgNegative">` + row.children[0].innerHTML
-        t += `<td class="cNum cbgNegative">`
-        t += `<td class="cUnified cbgNegative">` + row.children[1].innerHTML
+        t += `<td class="cNum ${bg}">` + row.children[0].innerHTML
+        t += `<td class="cNum ${bg}">`
+        t += `<td class="cUnified ${bg}">` + row.children[1].innerHTML
       }
-      if (row.children[3].className == 'cRight cbgPositive') {
+      let right = row.children[3].classList
+      if (right.contains('cbgPositive') || right.contains('cbgMoved')) {
+        let bg = right[1]
         add += `<tr>`
-        add += `<td class="cNum cbgPositive">`
-        add += `<td class="cNum cbgPositive">` + row.children[2].innerHTML
-        add += `<td class="cUnified cbgPositive">` + row.children[3].innerHTML
+        add += `<td class="cNum ${bg}">`
+        add += `<td class="cNum ${bg}">` + row.children[2].innerHTML
+        add += `<td class="cUnified ${bg}">` + row.children[3].innerHTML
       }
     }
     table.innerHTML = t + add
@@ -64,8 +69,8 @@ function selectSide(toenable, todisable) {
 }
 
 function handleclick(evt) {
-  if (evt.target.classList.contains('cRight')) selectSide(hRightSelect, hLeftSelect)
-  if (evt.target.classList.contains('cLeft')) selectSide(hLeftSelect, hRightSelect)
+  if (evt.target.closest('.cRight')) selectSide(hRightSelect, hLeftSelect)
+  if (evt.target.closest('.cLeft')) selectSide(hLeftSelect, hRightSelect)
 }
 
 hLeftSelect.disabled = true
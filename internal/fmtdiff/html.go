@@ -3,12 +3,14 @@ package fmtdiff
 import (
 	"fmt"
 	"html"
+	"slices"
 	"strconv"
 	"strings"
 
 	_ "embed"
 
 	"github.com/ypsu/effdump/internal/andiff"
+	"github.com/ypsu/effdump/internal/keyvalue"
 )
 
 //go:embed header.html
@@ -42,7 +44,8 @@ func zip(op andiff.Op, last bool, contextLines int) (pre, zipped, post int) {
 }
 
 // HTMLBuckets formats a list of diff buckets into a HTML document.
-func HTMLBuckets(buckets []Bucket, unchanged []string, contextLines int) string {
+// The info entries such as the baseline's metadata are rendered first.
+func HTMLBuckets(buckets []Bucket, unchanged []string, info []keyvalue.KV, contextLines int) string {
 	w := &strings.Builder{}
 	w.Grow(1 << 20)
 	printf := func(format string, args ...any) { fmt.Fprintf(w, format, args...) }
@@ -50,12 +53,14 @@ func HTMLBuckets(buckets []Bucket, unchanged []string, contextLines int) string
 	// Compute the width of the columns.
 	width := 40
 	for _, bucket := range buckets {
-		for _, e := range bucket.Entries {
-			for _, line := range e.Diff.LT {
-				width = max(width, len(line)+strings.Count(line, "\t")*7)
-			}
-			for _, line := range e.Diff.RT {
-				width = max(width, len(line)+strings.Count(line, "\t")*7)
+		for _, b := range append([]Bucket{bucket}, bucket.Similar...) {
+			for _, e := range b.Entries {
+				for _, line := range e.Diff.LT {
+					width = max(width, len(line)+strings.Count(line, "\t")*7)
+				}
+				for _, line := range e.Diff.RT {
+					width = max(width, len(line)+strings.Count(line, "\t")*7)
+				}
 			}
 		}
 	}
@@ -68,32 +73,87 @@ func HTMLBuckets(buckets []Bucket, unchanged []string, contextLines int) string
 	printf("%s\n", replacer.Replace(htmlHeader))
 	printf("<script>\n%s</script>\n\n", jsHeader)
 
+	// Render the info entries.
+	for _, kv := range info {
+		printf("<details open><summary>%s</summary><pre>%s</pre></details>\n<hr>\n\n", html.EscapeString(kv.K), html.EscapeString(kv.V))
+	}
+
 	// Render the diff table.
+	moveid := 0 // for the unique ids of the moved blocks' links
 	for bucketid, bucket := range buckets {
-		summarized := len(bucket.Entries) >= 10
-		printf("<p>bucket <a id=b%d href='#b%d'>#%d</a>: %d diffs</p>\n", bucketid+1, bucketid+1, bucketid+1, len(bucket.Entries))
+		// List the similar buckets' entries after the bucket's own, noting their similarity.
+		entries, similarity := bucket.Entries, make([]float64, len(bucket.Entries))
+		if len(bucket.Similar) > 0 {
+			entries = slices.Clone(entries)
+			for _, similar := range bucket.Similar {
+				entries = append(entries, similar.Entries...)
+				for range similar.Entries {
+					similarity = append(similarity, similar.Similarity)
+				}
+			}
+		}
+		summarized := len(entries) >= 10
+		printf("<p>bucket <a id=b%d href='#b%d'>#%d</a>: %d diffs</p>\n", bucketid+1, bucketid+1, bucketid+1, len(entries))
 		printf("<ul>\n")
-		for entryidx, entry := range bucket.Entries {
+		for entryidx, entry := range entries {
 			if summarized && entryidx == 7 {
-				printf("  <li><details><summary>... (additional %d similar diffs)</summary>\n", len(bucket.Entries)-entryidx)
+				printf("  <li><details><summary>... (additional %d similar diffs)</summary>\n", len(entries)-entryidx)
+			}
+			note := ""
+			if similarity[entryidx] > 0 {
+				note = fmt.Sprintf(" <span class=cfgNeutral>(%.0f%% similar)</span>", 100*similarity[entryidx])
 			}
-			printf("  <li><details%s><summary>%s</summary><table>\n", cond(entryidx == 0, " open", ""), html.EscapeString(entry.Name))
+			printf("  <li><details%s><summary>%s%s</summary>", cond(entryidx == 0, " open", ""), html.EscapeString(entry.Name), note)
+			if entry.JSON != nil {
+				printf("\n  <table class=cJSON>\n")
+				if len(entry.JSON) == 0 {
+					printf("    <tr><td class='cJSONPath cfgNeutral'>(no changes, only the formatting or the key order differs)</td>\n")
+				}
+				for _, c := range entry.JSON {
+					path := cond(c.Path == "", ".", c.Path)
+					printf("    <tr>\n")
+					printf("      <td class=cJSONPath>%s</td>\n", html.EscapeString(path))
+					printf("      <td class='cJSONValue %s'>%s</td>\n", cond(c.Old == "", "cbgNeutral", "cbgNegative"), html.EscapeString(c.Old))
+					printf("      <td class='cJSONValue %s'>%s</td>\n", cond(c.New == "", "cbgNeutral", "cbgPositive"), html.EscapeString(c.New))
+				}
+				printf("  </table>\n")
+			}
+			printf("<table>\n")
 
+			// The line numbers of the moved blocks' first lines link to the other side.
 			x, xi, y, yi := entry.Diff.LT, 0, entry.Diff.RT, 0
+			ltmoved, rtmoved := entry.Diff.Moved()
+			ltlinks, rtlinks := map[int]string{}, map[int]string{}
+			for _, m := range entry.Diff.Moves {
+				moveid++
+				ltlinks[m.Del] = fmt.Sprintf("<a id=m%dl href='#m%dr' title='moved to line %d'>%d</a>", moveid, moveid, m.Add+1, m.Del+1)
+				rtlinks[m.Add] = fmt.Sprintf("<a id=m%dr href='#m%dl' title='moved from line %d'>%d</a>", moveid, moveid, m.Del+1, m.Add+1)
+			}
+			delcells := func(xi int, line string) {
+				num, bg := cond(ltlinks[xi] != "", ltlinks[xi], strconv.Itoa(xi+1)), cond(ltmoved[xi], "cbgMoved", "cbgNegative")
+				printf("      <td class='cNum %s'>%s</td>\n", bg, num)
+				printf("      <td class='cLeft %s'>%s\n</td>\n", bg, line)
+			}
+			addcells := func(yi int, line string) {
+				num, bg := cond(rtlinks[yi] != "", rtlinks[yi], strconv.Itoa(yi+1)), cond(rtmoved[yi], "cbgMoved", "cbgPositive")
+				printf("      <td class='cNum %s'>%s</td>\n", bg, num)
+				printf("      <td class='cRight %s'>%s\n</td>\n", bg, line)
+			}
 			for opidx, op := range entry.Diff.Ops {
 				for i, k := 0, min(op.Del, op.Add); i < k; i++ {
+					var ltspans, rtspans []andiff.Span
+					if !ltmoved[xi] && !rtmoved[yi] {
+						ltspans, rtspans = andiff.Inline(x[xi], y[yi])
+					}
 					printf("    <tr>\n")
-					printf("      <td class='cNum cbgNegative'>%d</td>\n", xi+1)
-					printf("      <td class='cLeft cbgNegative'>%s\n</td>\n", html.EscapeString(x[xi]))
-					printf("      <td class='cNum cbgPositive'>%d</td>\n", yi+1)
-					printf("      <td class='cRight cbgPositive'>%s\n</td>\n", html.EscapeString(y[yi]))
+					delcells(xi, highlight(x[xi], ltspans, "<del>", "</del>", html.EscapeString))
+					addcells(yi, highlight(y[yi], rtspans, "<ins>", "</ins>", html.EscapeString))
 					xi, yi = xi+1, yi+1
 				}
 
 				for i, k := op.Add, op.Del; i < k; i++ {
 					printf("    <tr>\n")
-					printf("      <td class='cNum cbgNegative'>%d</td>\n", xi+1)
-					printf("      <td class='cLeft cbgNegative'>%s\n</td>\n", html.EscapeString(x[xi]))
+					delcells(xi, html.EscapeString(x[xi]))
 					printf("      <td class='cNum cbgNeutral'> </td>\n")
 					printf("      <td class='cRight cbgNeutral'></td>\n")
 					xi++
@@ -103,8 +163,7 @@ func HTMLBuckets(buckets []Bucket, unchanged []string, contextLines int) string
 					printf("    <tr>\n")
 					printf("      <td class='cNum cbgNeutral'> </td>\n")
 					printf("      <td class='cLeft cbgNeutral'></td>\n")
-					printf("      <td class='cNum cbgPositive'>%d</td>\n", yi+1)
-					printf("      <td class='cRight cbgPositive'>%s\n</td>\n", html.EscapeString(y[yi]))
+					addcells(yi, html.EscapeString(y[yi]))
 					yi++
 				}
 
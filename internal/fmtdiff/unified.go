@@ -7,24 +7,34 @@ import (
 
 	"github.com/ypsu/effdump/internal/andiff"
 	"github.com/ypsu/effdump/internal/edtextar"
+	"github.com/ypsu/effdump/internal/jsondiff"
 	"github.com/ypsu/effdump/internal/keyvalue"
 )
 
 // UnifiedBuckets formats a list of diff buckets into a edtextar.
-func UnifiedBuckets(buckets []Bucket, unchanged []string, sepch byte, contextLines int, colorize bool) string {
+// The info entries such as the baseline's metadata are printed first.
+func UnifiedBuckets(buckets []Bucket, unchanged []string, info []keyvalue.KV, sepch byte, contextLines int, colorize bool) string {
 	var kvs []keyvalue.KV
-	for bucketid, bucket := range buckets {
+	for _, kv := range info {
+		kvs = append(kvs, keyvalue.KV{kv.K, "\t" + strings.ReplaceAll(strings.TrimSuffix(kv.V, "\n"), "\n", "\n\t") + "\n"})
+	}
+	// render appends a bucket's first diff and the list of its other entries.
+	// label identifies the bucket in the titles.
+	render := func(bucket Bucket, label, omitted string) {
 		e := bucket.Entries[0]
-		title, diff := fmt.Sprintf("%s (%s, bucket %d)", e.Name, e.Comment, bucketid+1), Unified(e.Diff, contextLines, colorize)
+		title, diff := fmt.Sprintf("%s (%s, %s)", e.Name, e.Comment, label), Unified(e.Diff, contextLines, colorize)
 		if diff != "" {
 			diff = "\t" + strings.ReplaceAll(diff, "\n", "\n\t")
 		}
 		kvs = append(kvs, keyvalue.KV{title, diff})
+		if e.JSON != nil {
+			kvs = append(kvs, keyvalue.KV{fmt.Sprintf("%s (json changes, %s)", e.Name, label), formatJSON(e.JSON)})
+		}
 		cnt := len(bucket.Entries)
 		if cnt == 1 {
-			continue
+			return
 		}
-		tolist, title := cnt, fmt.Sprintf("(omitted %d similar diffs in bucket %d)", cnt-1, bucketid+1)
+		tolist := cnt
 		if tolist >= 10 {
 			tolist = 7
 		}
@@ -35,7 +45,14 @@ func UnifiedBuckets(buckets []Bucket, unchanged []string, sepch byte, contextLin
 		if cnt > tolist {
 			keys = append(keys, fmt.Sprintf("... (%d more entries)", cnt-tolist))
 		}
-		kvs = append(kvs, keyvalue.KV{title, "\t" + strings.Join(keys, "\n\t") + "\n"})
+		kvs = append(kvs, keyvalue.KV{omitted, "\t" + strings.Join(keys, "\n\t") + "\n"})
+	}
+	for bucketid, bucket := range buckets {
+		render(bucket, fmt.Sprintf("bucket %d", bucketid+1), fmt.Sprintf("(omitted %d similar diffs in bucket %d)", len(bucket.Entries)-1, bucketid+1))
+		for _, similar := range bucket.Similar {
+			label := fmt.Sprintf("bucket %d, %.0f%% similar", bucketid+1, 100*similar.Similarity)
+			render(similar, label, fmt.Sprintf("(omitted %d diffs identical to %s)", len(similar.Entries)-1, similar.Entries[0].Name))
+		}
 	}
 
 	tolist, title, extra := len(unchanged), fmt.Sprintf("(%d unchanged effects)", len(unchanged)), ""
@@ -47,22 +64,63 @@ func UnifiedBuckets(buckets []Bucket, unchanged []string, sepch byte, contextLin
 	return edtextar.Format(kvs, sepch) + "\n"
 }
 
+// formatJSON formats the structural changes as an indented edtextar section.
+func formatJSON(changes []jsondiff.Change) string {
+	if len(changes) == 0 {
+		return "\t(no changes, only the formatting or the key order differs)\n"
+	}
+	w := &strings.Builder{}
+	for _, c := range changes {
+		fmt.Fprintf(w, "\t%s\n", c)
+	}
+	return w.String()
+}
+
 // Unified returns unified diff, suitable for terminal output.
+// The lines of the moved blocks are marked with < where they were deleted and with > where they were added.
 func Unified(d andiff.Diff, contextLines int, colorize bool) string {
-	var delColor, addColor, noticeColor, normalColor string
+	var delColor, addColor, moveColor, noticeColor, normalColor string
 	if colorize {
-		delColor, addColor = "\033[31m", "\033[32m"
+		delColor, addColor, moveColor = "\033[31m", "\033[32m", "\033[36m"
 		noticeColor, normalColor = "\033[33m", "\033[0m"
 	}
 	w := &strings.Builder{}
 	w.Grow(256)
 	x, y, xi, yi := d.LT, d.RT, 0, 0
+	ltmoved, rtmoved := d.Moved()
 	for i, op := range d.Ops {
-		for xe := xi + op.Del; xi < xe; xi++ {
-			fmt.Fprintf(w, "%s-%s%s\n", delColor, x[xi], normalColor)
+		// Highlight the changed words of the paired lines in reverse video.
+		var ltspans, rtspans [][]andiff.Span
+		if colorize {
+			for k := 0; k < min(op.Del, op.Add); k++ {
+				var lt, rt []andiff.Span
+				if !ltmoved[xi+k] && !rtmoved[yi+k] {
+					lt, rt = andiff.Inline(x[xi+k], y[yi+k])
+				}
+				ltspans, rtspans = append(ltspans, lt), append(rtspans, rt)
+			}
+		}
+		for k, xe := 0, xi+op.Del; xi < xe; k, xi = k+1, xi+1 {
+			line := x[xi]
+			if k < len(ltspans) {
+				line = highlight(line, ltspans[k], "\033[7m", "\033[27m", nil)
+			}
+			if ltmoved[xi] {
+				fmt.Fprintf(w, "%s<%s%s\n", moveColor, line, normalColor)
+			} else {
+				fmt.Fprintf(w, "%s-%s%s\n", delColor, line, normalColor)
+			}
 		}
-		for ye := yi + op.Add; yi < ye; yi++ {
-			fmt.Fprintf(w, "%s+%s%s\n", addColor, y[yi], normalColor)
+		for k, ye := 0, yi+op.Add; yi < ye; k, yi = k+1, yi+1 {
+			line := y[yi]
+			if k < len(rtspans) {
+				line = highlight(line, rtspans[k], "\033[7m", "\033[27m", nil)
+			}
+			if rtmoved[yi] {
+				fmt.Fprintf(w, "%s>%s%s\n", moveColor, line, normalColor)
+			} else {
+				fmt.Fprintf(w, "%s+%s%s\n", addColor, line, normalColor)
+			}
 		}
 		w.WriteString(normalColor)
 		pre, zipped, post := zip(op, i == len(d.Ops)-1, contextLines)
@@ -83,3 +141,24 @@ func Unified(d andiff.Diff, contextLines int, colorize bool) string {
 	}
 	return w.String()
 }
+
+// highlight wraps the spans of line into on and off.
+// The escape function, if non-nil, is applied to the pieces of the line.
+func highlight(line string, spans []andiff.Span, on, off string, escape func(string) string) string {
+	if escape == nil {
+		escape = func(s string) string { return s }
+	}
+	if len(spans) == 0 {
+		return escape(line)
+	}
+	w, pos := &strings.Builder{}, 0
+	for _, s := range spans {
+		w.WriteString(escape(line[pos:s.Start]))
+		w.WriteString(on)
+		w.WriteString(escape(line[s.Start:s.End]))
+		w.WriteString(off)
+		pos = s.End
+	}
+	w.WriteString(escape(line[pos:]))
+	return w.String()
+}
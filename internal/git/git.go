@@ -6,6 +6,7 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+	"path/filepath"
 )
 
 // VersionSystem implements git version lookup via parsing `git` CLI tool's output.
@@ -38,3 +39,35 @@ func (*VersionSystem) Resolve(_ context.Context, rev string) (version string, er
 	}
 	return string(bytes.TrimSpace(fields[0])), nil
 }
+
+// AddWorktree checks out rev into dir as a detached git worktree.
+// Returns the directory in the worktree that corresponds to the current working directory.
+// The worktree must be cleaned up with the returned remove function.
+func (*VersionSystem) AddWorktree(ctx context.Context, rev, dir string) (workdir string, remove func() error, err error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	prefix, err := exec.CommandContext(ctx, "git", "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("git/exec rev-parse: %v (not in git directory?)", err)
+	}
+	if output, err := exec.CommandContext(ctx, "git", "worktree", "add", "--detach", dir, rev).CombinedOutput(); err != nil {
+		return "", nil, fmt.Errorf("git/exec worktree add: %v\n%s", err, output)
+	}
+	remove = func() error {
+		if output, err := exec.Command("git", "worktree", "remove", "--force", dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("git/exec worktree remove: %v\n%s", err, output)
+		}
+		return nil
+	}
+	return filepath.Join(dir, string(bytes.TrimSpace(prefix))), remove, nil
+}
+
+// Describe returns the subject of version's commit.
+func (*VersionSystem) Describe(ctx context.Context, version string) (string, error) {
+	output, err := exec.CommandContext(ctx, "git", "log", "-1", "--format=%s", version, "--").Output()
+	if err != nil {
+		return "", fmt.Errorf("git/exec log: %v", err)
+	}
+	return string(bytes.TrimSpace(output)), nil
+}
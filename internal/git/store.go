@@ -0,0 +1,98 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// Store stores the dumps as git blobs under the refs/effdump/<name>/<version> refs.
+// This makes them shareable with plain git:
+//
+//	git push origin 'refs/effdump/*:refs/effdump/*'
+//	git fetch origin 'refs/effdump/*:refs/effdump/*'
+type Store struct {
+	dir, prefix string
+}
+
+// NewStore returns a Store for the name effdump in the git repository in dir.
+// Uses the current directory's repository if dir is empty.
+func NewStore(dir, name string) *Store {
+	return &Store{dir, "refs/effdump/" + name + "/"}
+}
+
+// String returns the ref namespace of the store.
+func (s *Store) String() string { return strings.TrimSuffix(s.prefix, "/") }
+
+// run runs a git subcommand with stdin as its input and returns its stdout.
+func (s *Store) run(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir, cmd.Stdin = s.dir, bytes.NewReader(stdin)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git/exec %s: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return output, nil
+}
+
+// lookup returns the blob ID version refers to.
+// Only a missing ref is fs.ErrNotExist, the other failures such as not being in a git repository are returned as is.
+func (s *Store) lookup(ctx context.Context, version string) (string, error) {
+	output, err := s.run(ctx, nil, "rev-parse", "--verify", "--quiet", s.prefix+version+"^{blob}")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", fmt.Errorf("git/lookup %s%s: %w", s.prefix, version, fs.ErrNotExist)
+	}
+	if err != nil {
+		return "", fmt.Errorf("git/lookup %s%s: %v", s.prefix, version, err)
+	}
+	return string(bytes.TrimSpace(output)), nil
+}
+
+// Get reads version's dump from its blob.
+func (s *Store) Get(ctx context.Context, version string) ([]byte, error) {
+	blob, err := s.lookup(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+	return s.run(ctx, nil, "cat-file", "blob", blob)
+}
+
+// Put writes version's dump into a new blob and points version's ref to it.
+func (s *Store) Put(ctx context.Context, version string, data []byte) error {
+	output, err := s.run(ctx, data, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return err
+	}
+	_, err = s.run(ctx, nil, "update-ref", s.prefix+version, string(bytes.TrimSpace(output)))
+	return err
+}
+
+// List returns the versions in the ref namespace.
+func (s *Store) List(ctx context.Context) ([]string, error) {
+	output, err := s.run(ctx, nil, "for-each-ref", "--format=%(refname)", s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, ref := range strings.Fields(string(output)) {
+		versions = append(versions, strings.TrimPrefix(ref, s.prefix))
+	}
+	return versions, nil
+}
+
+// Delete deletes version's ref.
+// The blob itself is left for git's garbage collection.
+func (s *Store) Delete(ctx context.Context, version string) error {
+	if _, err := s.lookup(ctx, version); err != nil {
+		return err
+	}
+	_, err := s.run(ctx, nil, "update-ref", "-d", s.prefix+version)
+	return err
+}
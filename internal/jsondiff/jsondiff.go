@@ -0,0 +1,177 @@
+// Package jsondiff computes the structural diff of two JSON documents.
+// The changes are reported by JSON path such as .Deployments[3].MemGB and the order of the object keys is ignored.
+package jsondiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ypsu/effdump/internal/andiff"
+)
+
+// Change is a difference at a JSON path.
+type Change struct {
+	// The path of the changed value such as .Deployments[3].MemGB, empty for the root.
+	Path string
+
+	// The compact JSON of the old and new value, empty if the path doesn't exist on that side.
+	Old, New string
+}
+
+// String formats the change as "<path>: <old> → <new>".
+func (c Change) String() string {
+	path, old, new := c.Path, c.Old, c.New
+	if path == "" {
+		path = "."
+	}
+	if old == "" {
+		old = "(missing)"
+	}
+	if new == "" {
+		new = "(missing)"
+	}
+	return fmt.Sprintf("%s: %s → %s", path, old, new)
+}
+
+// Compute returns the changes from the lt to the rt JSON document.
+// The array elements are matched up by a line diff of their compact JSON so an inserted element doesn't change all the following ones.
+// Returns nil if either side is not a JSON object or array.
+// Returns an empty non-nil slice if the documents are semantically the same, e.g. only their key order differs.
+func Compute(lt, rt string) []Change {
+	a, ok := parse(lt)
+	if !ok {
+		return nil
+	}
+	b, ok := parse(rt)
+	if !ok {
+		return nil
+	}
+	changes := []Change{}
+	diff("", a, b, &changes)
+	return changes
+}
+
+// parse parses s if it's a JSON object or array.
+// It keeps the numbers as json.Number so that they are reported as written.
+func parse(s string) (any, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || s[0] != '{' && s[0] != '[' {
+		return nil, false
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, false
+	}
+	return v, true
+}
+
+// compact returns the compact JSON of v with the object keys sorted.
+func compact(v any) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err.Error()
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// keyPath appends an object key to path.
+func keyPath(path, key string) string {
+	if identRE.MatchString(key) {
+		return path + "." + key
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+// diff appends the changes from a to b to changes.
+func diff(path string, a, b any, changes *[]Change) {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			av, aok := a[k]
+			bv, bok := b[k]
+			switch {
+			case !bok:
+				*changes = append(*changes, Change{keyPath(path, k), compact(av), ""})
+			case !aok:
+				*changes = append(*changes, Change{keyPath(path, k), "", compact(bv)})
+			default:
+				diff(keyPath(path, k), av, bv, changes)
+			}
+		}
+		return
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			break
+		}
+		diffArrays(path, a, b, changes)
+		return
+	}
+	if old, new := compact(a), compact(b); old != new {
+		*changes = append(*changes, Change{path, old, new})
+	}
+}
+
+// diffArrays appends the changes from the a to the b array to changes.
+// The changed elements are reported at their new index, the removed ones at their old index.
+func diffArrays(path string, a, b []any, changes *[]Change) {
+	index := func(i int) string { return fmt.Sprintf("%s[%d]", path, i) }
+	if len(a) == 0 || len(b) == 0 {
+		for i, v := range a {
+			*changes = append(*changes, Change{index(i), compact(v), ""})
+		}
+		for i, v := range b {
+			*changes = append(*changes, Change{index(i), "", compact(v)})
+		}
+		return
+	}
+	lines := func(vs []any) string {
+		w := &strings.Builder{}
+		for _, v := range vs {
+			w.WriteString(compact(v) + "\n")
+		}
+		return w.String()
+	}
+	xi, yi := 0, 0
+	for _, op := range andiff.ComputeAlgo(andiff.Myers, lines(a), lines(b), nil).Ops {
+		for k := 0; k < min(op.Del, op.Add); k++ {
+			diff(index(yi+k), a[xi+k], b[yi+k], changes)
+		}
+		for k := op.Add; k < op.Del; k++ {
+			*changes = append(*changes, Change{index(xi + k), compact(a[xi+k]), ""})
+		}
+		for k := op.Del; k < op.Add; k++ {
+			*changes = append(*changes, Change{index(yi + k), "", compact(b[yi+k])})
+		}
+		xi, yi = xi+op.Del+op.Keep, yi+op.Add+op.Keep
+	}
+}